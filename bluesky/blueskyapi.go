@@ -2,6 +2,7 @@ package blueskyapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,17 +13,46 @@ import (
 	"time"
 
 	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/logging"
+)
+
+var log = logging.For("bluesky")
+
+// The error body that XRPC endpoints return
+type XRPCError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrInvalidSwap    = errors.New("record was changed by someone else")
+	ErrUnauthorized   = errors.New("token was rejected")
+
+	// Ways logging in can fail
+	ErrInvalidCredentials      = errors.New("invalid identifier or password")
+	ErrAuthFactorTokenRequired = errors.New("an email sign in code is required")
+	ErrInvalidAuthFactorToken  = errors.New("the email sign in code is invalid")
+	ErrAccountTakedown         = errors.New("account has been taken down")
+	ErrRateLimited             = errors.New("rate limited")
+	ErrIdentityMismatch        = errors.New("session doesn't match the account's identity")
 )
 
 type AuthResponse struct {
-	AccessJwt  string `json:"accessJwt"`
-	RefreshJwt string `json:"refreshJwt"`
-	DID        string `json:"did"`
+	AccessJwt  string       `json:"accessJwt"`
+	RefreshJwt string       `json:"refreshJwt"`
+	DID        string       `json:"did"`
+	Handle     string       `json:"handle"`
+	DIDDoc     *DIDDocument `json:"didDoc"`
+	// The PDS we logged in to. Authenticate sets this over anything the PDS sends.
+	// It's kept in the JSON, as three legged OAuth stores the login until the client exchanges its request token.
+	PDS string `json:"pds"`
 }
 
 type AuthRequest struct {
-	Identifier string `json:"identifier"`
-	Password   string `json:"password"`
+	Identifier      string `json:"identifier"`
+	Password        string `json:"password"`
+	AuthFactorToken string `json:"authFactorToken,omitempty"`
 }
 
 type Author struct {
@@ -44,6 +74,7 @@ type Author struct {
 		Labeler      bool      `json:"labeler"`
 		CreatedAt    time.Time `json:"created_at"`
 	}
+	JoinedViaStarterPack *StarterPack `json:"joinedViaStarterPack"` // Only in app.bsky.actor.getProfile
 }
 
 type PostRecord struct {
@@ -53,6 +84,18 @@ type PostRecord struct {
 	Facets    []Facet   `json:"facets"`
 	Langs     []string  `json:"langs"`
 	Text      string    `json:"text"`
+	Via       string    `json:"via"`    // The app that made the post. Not part of the lexicon, but a few clients set it.
+	ViaURL    string    `json:"viaUrl"` // Only set by us, so we can link to the app like twitter did.
+}
+
+// The post record we send when creating a post. This is seperate from PostRecord, as we can't send an empty embed.
+type NewPostRecord struct {
+	Type      string   `json:"$type"`
+	Text      string   `json:"text"`
+	CreatedAt string   `json:"createdAt"`
+	Langs     []string `json:"langs,omitempty"`
+	Via       string   `json:"via,omitempty"`
+	ViaURL    string   `json:"viaUrl,omitempty"`
 }
 
 // Specifically for reposts
@@ -98,6 +141,7 @@ type Feature struct {
 	Type string `json:"$type"`
 	Tag  string `json:"tag"`
 	Did  string `json:"did"`
+	URI  string `json:"uri"`
 }
 
 type Index struct {
@@ -143,6 +187,32 @@ type Timeline struct {
 	Cursor string `json:"cursor"`
 }
 
+type SearchResults struct {
+	Posts     []Post `json:"posts"`
+	Cursor    string `json:"cursor"`
+	HitsTotal int    `json:"hitsTotal"`
+}
+
+type Notification struct {
+	URI           string          `json:"uri"`
+	CID           string          `json:"cid"`
+	Author        Author          `json:"author"`
+	Reason        string          `json:"reason"`
+	ReasonSubject string          `json:"reasonSubject"`
+	Record        json.RawMessage `json:"record"`
+	IsRead        bool            `json:"isRead"`
+	IndexedAt     time.Time       `json:"indexedAt"`
+}
+
+type Notifications struct {
+	Notifications []Notification `json:"notifications"`
+	Cursor        string         `json:"cursor"`
+}
+
+type Posts struct {
+	Posts []Post `json:"posts"`
+}
+
 type Thread struct {
 	Type    string `json:"$type"`
 	Post    Post   `json:"post"`
@@ -157,9 +227,9 @@ type ThreadRoot struct {
 
 // Reposting/Retweeting
 type CreateRecordPayload struct {
-	Collection string       `json:"collection"`
-	Repo       string       `json:"repo"`
-	Record     RepostRecord `json:"record"`
+	Collection string      `json:"collection"`
+	Repo       string      `json:"repo"`
+	Record     interface{} `json:"record"`
 }
 
 type DeleteRecordPayload struct {
@@ -168,6 +238,14 @@ type DeleteRecordPayload struct {
 	RKey       string `json:"rkey"`
 }
 
+type PutRecordPayload struct {
+	Repo       string      `json:"repo"`
+	Collection string      `json:"collection"`
+	RKey       string      `json:"rkey"`
+	Record     interface{} `json:"record"`
+	SwapRecord *string     `json:"swapRecord,omitempty"`
+}
+
 type RepostRecord struct {
 	Type      string  `json:"$type"`
 	CreatedAt string  `json:"createdAt"`
@@ -207,12 +285,93 @@ type ItemByWithDate struct {
 	Actor     Author    `json:"actor"`
 }
 
-func Authenticate(username, password string) (*AuthResponse, error) {
-	url := "https://bsky.social/xrpc/com.atproto.server.createSession"
+type Follows struct {
+	Subject Author   `json:"subject"`
+	Cursor  string   `json:"cursor"`
+	Follows []Author `json:"follows"`
+}
+
+// A raw record from com.atproto.repo.listRecords. Value is left undecoded, as it's shape depends on the collection.
+type Record struct {
+	Subject
+	Value json.RawMessage `json:"value"`
+}
+
+type RecordList struct {
+	Cursor  string   `json:"cursor"`
+	Records []Record `json:"records"`
+}
+
+type Suggestions struct {
+	Cursor string   `json:"cursor"`
+	Actors []Author `json:"actors"`
+}
+
+type StarterPackRecord struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	List        string    `json:"list"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Both the basic & full starter pack views. List is only in the full view.
+type StarterPack struct {
+	Subject
+	Record        StarterPackRecord `json:"record"`
+	Creator       Author            `json:"creator"`
+	List          *ListView         `json:"list"`
+	ListItemCount int               `json:"listItemCount"`
+	IndexedAt     string            `json:"indexedAt"`
+}
+
+type StarterPacks struct {
+	Cursor       string        `json:"cursor"`
+	StarterPacks []StarterPack `json:"starterPacks"`
+}
+
+type ListView struct {
+	Subject
+	Name          string `json:"name"`
+	Purpose       string `json:"purpose"`
+	Description   string `json:"description"`
+	ListItemCount int    `json:"listItemCount"`
+}
+
+type ListItem struct {
+	URI     string `json:"uri"`
+	Subject Author `json:"subject"`
+}
+
+type List struct {
+	Cursor string     `json:"cursor"`
+	List   ListView   `json:"list"`
+	Items  []ListItem `json:"items"`
+}
+
+// The value of an app.bsky.graph.follow record
+type FollowRecord struct {
+	Type      string    `json:"$type"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// The value of an app.bsky.feed.like record
+type LikeRecord struct {
+	Type      string    `json:"$type"`
+	Subject   Subject   `json:"subject"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// https://docs.bsky.app/docs/api/com-atproto-server-create-session
+// authFactorToken is the code bluesky emails to accounts with 2FA turned on, and can be left empty.
+func Authenticate(ctx context.Context, username, password string, authFactorToken string) (*AuthResponse, error) {
+	pds := resolveIdentifierPDS(ctx, username)
+	url := pds + "/xrpc/com.atproto.server.createSession"
 
 	authReq := AuthRequest{
-		Identifier: username,
-		Password:   password,
+		Identifier:      username,
+		Password:        password,
+		AuthFactorToken: authFactorToken,
 	}
 
 	reqBody, err := json.Marshal(authReq)
@@ -220,17 +379,43 @@ func Authenticate(username, password string) (*AuthResponse, error) {
 		return nil, err
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(reqBody))
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+
+		var xrpcError XRPCError
+		if err := json.Unmarshal(bodyBytes, &xrpcError); err == nil {
+			switch xrpcError.Error {
+			case "AuthenticationRequired":
+				return nil, ErrInvalidCredentials
+			case "AuthFactorTokenRequired":
+				return nil, ErrAuthFactorTokenRequired
+			case "InvalidToken":
+				return nil, ErrInvalidAuthFactorToken
+			case "AccountTakedown":
+				return nil, ErrAccountTakedown
+			case "RateLimitExceeded":
+				return nil, ErrRateLimited
+			}
+		}
 		return nil, errors.New("authentication failed")
 	}
 
@@ -238,23 +423,27 @@ func Authenticate(username, password string) (*AuthResponse, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
 		return nil, err
 	}
+	authResp.PDS = pds
 
 	return &authResp, nil
 }
 
-// TODO: This looks like it's a bsky.social specific endpoint, can we get the user's server?
-func RefreshToken(refreshToken string) (*AuthResponse, error) {
-	url := "https://bsky.social/xrpc/com.atproto.server.refreshSession"
+func RefreshToken(ctx context.Context, refreshToken string) (*AuthResponse, error) {
+	pds, err := pdsURL(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/com.atproto.server.refreshSession"
 
 	client := &http.Client{}
 
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+refreshToken)
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
@@ -263,8 +452,7 @@ func RefreshToken(refreshToken string) (*AuthResponse, error) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return nil, errors.New("reauth failed")
 	}
 
@@ -276,11 +464,58 @@ func RefreshToken(refreshToken string) (*AuthResponse, error) {
 	return &authResp, nil
 }
 
-func GetUserInfo(token string, screen_name string) (*bridge.TwitterUser, error) {
-	url := "https://public.api.bsky.app/xrpc/app.bsky.actor.getProfile" + "?actor=" + screen_name
+// https://docs.bsky.app/docs/api/com-atproto-server-delete-session
+func DeleteSession(ctx context.Context, refreshToken string) error {
+	pds, err := pdsURL(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	url := pds + "/xrpc/com.atproto.server.deleteSession"
+
+	client := &http.Client{}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return errors.New("failed to delete session")
+	}
+
+	return nil
+}
+
+func GetUserInfo(ctx context.Context, token string, screen_name string) (*bridge.TwitterUser, error) {
+	author, err := GetProfile(ctx, token, screen_name)
+	if err != nil {
+		return nil, err
+	}
+
+	return AuthorTTB(*author), nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-actor-get-profile
+// This can be used without a token, in which case it goes straight to the public app view.
+func GetProfile(ctx context.Context, token string, actor string) (*Author, error) {
+	appView, err := appViewURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := appView + "/xrpc/app.bsky.actor.getProfile" + "?actor=" + actor
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -288,7 +523,7 @@ func GetUserInfo(token string, screen_name string) (*bridge.TwitterUser, error)
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
@@ -296,8 +531,7 @@ func GetUserInfo(token string, screen_name string) (*bridge.TwitterUser, error)
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return nil, errors.New("failed to fetch user info")
 	}
 
@@ -306,14 +540,19 @@ func GetUserInfo(token string, screen_name string) (*bridge.TwitterUser, error)
 		return nil, err
 	}
 
-	return AuthorTTB(author), nil
+	return &author, nil
 }
 
-func GetUsersInfo(token string, items []string) ([]*bridge.TwitterUser, error) {
-	url := "https://public.api.bsky.app/xrpc/app.bsky.actor.getProfiles" + "?actors=" + strings.Join(items, "&actors=")
+// This can be used without a token, in which case it goes straight to the public app view.
+func GetUsersInfo(ctx context.Context, token string, items []string) ([]*bridge.TwitterUser, error) {
+	appView, err := appViewURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := appView + "/xrpc/app.bsky.actor.getProfiles" + "?actors=" + strings.Join(items, "&actors=")
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -321,7 +560,7 @@ func GetUsersInfo(token string, items []string) ([]*bridge.TwitterUser, error) {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
@@ -329,8 +568,7 @@ func GetUsersInfo(token string, items []string) ([]*bridge.TwitterUser, error) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return nil, errors.New("failed to fetch user info")
 	}
 
@@ -350,6 +588,7 @@ func GetUsersInfo(token string, items []string) ([]*bridge.TwitterUser, error) {
 }
 
 func AuthorTTB(author Author) *bridge.TwitterUser {
+	description, location, profileURL := bridge.ParseProfileDescription(author.Description)
 	return &bridge.TwitterUser{
 		ProfileSidebarFillColor:   "e0ff92",
 		Name:                      author.DisplayName,
@@ -357,11 +596,11 @@ func AuthorTTB(author Author) *bridge.TwitterUser {
 		ProfileBackgroundTile:     false,
 		CreatedAt:                 author.CreatedAt,
 		ProfileImageURL:           "http://10.0.0.77:3000/cdn/img/?url=" + url.QueryEscape(author.Avatar) + ":thumb",
-		Location:                  "",
+		Location:                  location,
 		ProfileLinkColor:          "0000ff",
 		IsTranslator:              false,
 		ContributorsEnabled:       false,
-		URL:                       "",
+		URL:                       profileURL,
 		FavouritesCount:           0,
 		UtcOffset:                 nil,
 		ID:                        *bridge.BlueSkyToTwitterID(author.DID),
@@ -375,7 +614,7 @@ func AuthorTTB(author Author) *bridge.TwitterUser {
 		Verified:                  false,
 		ProfileBackgroundColor:    "c0deed",
 		GeoEnabled:                false,
-		Description:               author.Description,
+		Description:               description,
 		FriendsCount:              author.FollowsCount,
 		StatusesCount:             author.PostsCount,
 		ScreenName:                author.Handle,
@@ -383,20 +622,24 @@ func AuthorTTB(author Author) *bridge.TwitterUser {
 }
 
 // https://docs.bsky.app/docs/api/app-bsky-feed-get-feed
-func GetTimeline(token string, context string) (error, *Timeline) {
-	url := "https://public.bsky.social/xrpc/app.bsky.feed.getTimeline"
-	if context != "" {
-		url = "https://public.bsky.social/xrpc/app.bsky.feed.getTimeline?context=" + context
+func GetTimeline(ctx context.Context, token string, cursor string, limit int) (error, *Timeline) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return err, nil
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.feed.getTimeline?limit=%d", limit)
+	if cursor != "" {
+		url += "&cursor=" + cursor
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err, nil
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return err, nil
 	}
@@ -410,8 +653,7 @@ func GetTimeline(token string, context string) (error, *Timeline) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return errors.New("failed to fetch timeline"), nil
 	}
 
@@ -423,19 +665,187 @@ func GetTimeline(token string, context string) (error, *Timeline) {
 	return nil, &feeds
 }
 
-func GetPost(token string, uri string, depth int, parentHeight int) (error, *ThreadRoot) {
+// https://docs.bsky.app/docs/api/app-bsky-feed-get-feed
+// This can be used without a token, in which case it goes straight to the public app view.
+func GetFeed(ctx context.Context, token string, feed string, limit int, cursor string) (*Timeline, error) {
+	appView, err := appViewURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := appView + fmt.Sprintf("/xrpc/app.bsky.feed.getFeed?limit=%d&feed=%s", limit, feed)
+	if cursor != "" {
+		url += "&cursor=" + cursor
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch feed")
+	}
+
+	feeds := Timeline{}
+	if err := json.NewDecoder(resp.Body).Decode(&feeds); err != nil {
+		return nil, err
+	}
+
+	return &feeds, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-feed-get-author-feed
+func GetAuthorFeed(ctx context.Context, token string, actor string, limit int, cursor string) (*Timeline, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.feed.getAuthorFeed?limit=%d&actor=%s", limit, actor)
+	if cursor != "" {
+		url += "&cursor=" + cursor
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch author feed")
+	}
+
+	feeds := Timeline{}
+	if err := json.NewDecoder(resp.Body).Decode(&feeds); err != nil {
+		return nil, err
+	}
+
+	return &feeds, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-notification-list-notifications
+// reasons limits which kinds of notifications we get back, eg. "repost". Leave it empty to get all of them.
+func ListNotifications(ctx context.Context, token string, reasons []string, limit int, cursor string) (*Notifications, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.notification.listNotifications?limit=%d", limit)
+	for _, reason := range reasons {
+		url += "&reasons=" + reason
+	}
+	if cursor != "" {
+		url += "&cursor=" + cursor
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch notifications")
+	}
+
+	notifications := Notifications{}
+	if err := json.NewDecoder(resp.Body).Decode(&notifications); err != nil {
+		return nil, err
+	}
+
+	return &notifications, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-feed-get-posts
+// Bluesky only lets us get 25 posts at a time.
+func GetPosts(ctx context.Context, token string, uris []string) ([]Post, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/app.bsky.feed.getPosts?uris=" + strings.Join(uris, "&uris=")
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch posts")
+	}
+
+	posts := Posts{}
+	if err := json.NewDecoder(resp.Body).Decode(&posts); err != nil {
+		return nil, err
+	}
+
+	return posts.Posts, nil
+}
+
+func GetPost(ctx context.Context, token string, uri string, depth int, parentHeight int) (error, *ThreadRoot) {
 	// Example URL at://did:plc:dqibjxtqfn6hydazpetzr2w4/app.bsky.feed.post/3lchbospvbc2j
 
-	url := "https://public.bsky.social/xrpc/app.bsky.feed.getPostThread?depth=" + fmt.Sprintf("%d", depth) + "&parentHeight=" + fmt.Sprintf("%d", parentHeight) + "&uri=" + uri
+	// Without a token, this goes to the public app view instead
+	appView, err := appViewURL(ctx, token)
+	if err != nil {
+		return err, nil
+	}
+	url := appView + "/xrpc/app.bsky.feed.getPostThread?depth=" + fmt.Sprintf("%d", depth) + "&parentHeight=" + fmt.Sprintf("%d", parentHeight) + "&uri=" + uri
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err, nil
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return err, nil
 	}
@@ -449,8 +859,7 @@ func GetPost(token string, uri string, depth int, parentHeight int) (error, *Thr
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return errors.New("failed to fetch timeline"), nil
 	}
 
@@ -462,42 +871,75 @@ func GetPost(token string, uri string, depth int, parentHeight int) (error, *Thr
 	return nil, &thread
 }
 
-func UpdateStatus(token string, status string) error {
-	url := "https://public.bsky.social/xrpc/com.atproto.repo.createRecord"
+// via & viaURL are the name and website of the app that made the post, and can be left empty.
+func UpdateStatus(ctx context.Context, token string, my_did string, status string, langs []string, via string, viaURL string) (*CreateRecordResult, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/com.atproto.repo.createRecord"
+
+	payload := CreateRecordPayload{
+		Collection: "app.bsky.feed.post",
+		Repo:       my_did,
+		Record: NewPostRecord{
+			Type:      "app.bsky.feed.post",
+			Text:      status,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Langs:     langs,
+			Via:       via,
+			ViaURL:    viaURL,
+		},
+	}
+
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("failed to marshal payload")
+	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
-		return nil
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to update status")
+	}
+
+	result := CreateRecordResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
 	}
-	return errors.New("failed to update status")
+
+	return &result, nil
 }
 
-func ReTweet(token string, id string, my_did string) (error, *ThreadRoot, *string) {
-	url := "https://bsky.social/xrpc/com.atproto.repo.createRecord"
+func ReTweet(ctx context.Context, token string, id string, my_did string) (error, *ThreadRoot, *string) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return err, nil, nil
+	}
+	url := pds + "/xrpc/com.atproto.repo.createRecord"
 
-	err, thread := GetPost(token, id, 0, 1)
+	err, thread := GetPost(ctx, token, id, 0, 1)
 
 	if err != nil {
 		return errors.New("failed to fetch post"), nil, nil
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return err, nil, nil
 	}
@@ -525,7 +967,7 @@ func ReTweet(token string, id string, my_did string) (error, *ThreadRoot, *strin
 
 	// if it works, we should get something like:
 	// {"uri":"at://did:plc:khcyntihpu7snjszuojjgjc4/app.bsky.feed.repost/3lcm7b2pjio22","cid":"bafyreidw2uvnhns5bacdii7gozrou4rg25cpcxhe6cbhfws2c5hpsvycdm","commit":{"cid":"bafyreicu7db6k3vxbvtwiumggynbps7cuozsofbvo3kq7lz723smvpxne4","rev":"3lcm7b2ptb622"},"validationStatus":"valid"}
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return err, nil, nil
 	}
@@ -534,8 +976,7 @@ func ReTweet(token string, id string, my_did string) (error, *ThreadRoot, *strin
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return errors.New("failed to retweet: " + bodyString), nil, nil
 	}
 
@@ -547,17 +988,21 @@ func ReTweet(token string, id string, my_did string) (error, *ThreadRoot, *strin
 	return nil, thread, &repost.URI
 }
 
-func LikePost(token string, id string, my_did string) (error, *ThreadRoot) {
-	url := "https://bsky.social/xrpc/com.atproto.repo.createRecord"
+func LikePost(ctx context.Context, token string, id string, my_did string) (error, *ThreadRoot) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return err, nil
+	}
+	url := pds + "/xrpc/com.atproto.repo.createRecord"
 
-	err, thread := GetPost(token, id, 0, 1)
+	err, thread := GetPost(ctx, token, id, 0, 1)
 
 	if err != nil {
 		return errors.New("failed to fetch post"), nil
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return err, nil
 	}
@@ -585,7 +1030,7 @@ func LikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 
 	// if it works, we should get something like:
 	// {"uri":"at://did:plc:khcyntihpu7snjszuojjgjc4/app.bsky.feed.repost/3lcm7b2pjio22","cid":"bafyreidw2uvnhns5bacdii7gozrou4rg25cpcxhe6cbhfws2c5hpsvycdm","commit":{"cid":"bafyreicu7db6k3vxbvtwiumggynbps7cuozsofbvo3kq7lz723smvpxne4","rev":"3lcm7b2ptb622"},"validationStatus":"valid"}
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return err, nil
 	}
@@ -594,8 +1039,7 @@ func LikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return errors.New("failed to retweet: " + bodyString), nil
 	}
 
@@ -609,17 +1053,21 @@ func LikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 	return nil, thread
 }
 
-func UnlikePost(token string, id string, my_did string) (error, *ThreadRoot) {
-	url := "https://bsky.social/xrpc/com.atproto.repo.deleteRecord"
+func UnlikePost(ctx context.Context, token string, id string, my_did string) (error, *ThreadRoot) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return err, nil
+	}
+	url := pds + "/xrpc/com.atproto.repo.deleteRecord"
 
-	err, thread := GetPost(token, id, 0, 1)
+	err, thread := GetPost(ctx, token, id, 0, 1)
 
 	if err != nil {
 		return errors.New("failed to fetch post"), nil
 	}
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return err, nil
 	}
@@ -640,7 +1088,7 @@ func UnlikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 
 	// if it works, we should get something like:
 	// {"uri":"at://did:plc:khcyntihpu7snjszuojjgjc4/app.bsky.feed.repost/3lcm7b2pjio22","cid":"bafyreidw2uvnhns5bacdii7gozrou4rg25cpcxhe6cbhfws2c5hpsvycdm","commit":{"cid":"bafyreicu7db6k3vxbvtwiumggynbps7cuozsofbvo3kq7lz723smvpxne4","rev":"3lcm7b2ptb622"},"validationStatus":"valid"}
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return err, nil
 	}
@@ -649,8 +1097,7 @@ func UnlikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return errors.New("failed to retweet: " + bodyString), nil
 	}
 
@@ -664,17 +1111,21 @@ func UnlikePost(token string, id string, my_did string) (error, *ThreadRoot) {
 	return nil, thread
 }
 
-func GetLikes(token string, uri string, limit int) (*Likes, error) {
-	url := fmt.Sprintf("https://public.bsky.social/xrpc/app.bsky.feed.getLikes?limit=%d&uri=%s", limit, uri)
+func GetLikes(ctx context.Context, token string, uri string, limit int) (*Likes, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.feed.getLikes?limit=%d&uri=%s", limit, uri)
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
@@ -688,8 +1139,7 @@ func GetLikes(token string, uri string, limit int) (*Likes, error) {
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return nil, errors.New("failed to fetch timeline")
 	}
 
@@ -701,17 +1151,21 @@ func GetLikes(token string, uri string, limit int) (*Likes, error) {
 	return &likes, nil
 }
 
-func GetRetweetAuthors(token string, uri string, limit int) (*RepostedBy, error) {
-	url := fmt.Sprintf("https://public.bsky.social/xrpc/app.bsky.feed.getRepostedBy?limit=%d&uri=%s", limit, uri)
+func GetRetweetAuthors(ctx context.Context, token string, uri string, limit int) (*RepostedBy, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.feed.getRepostedBy?limit=%d&uri=%s", limit, uri)
 
 	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := client.Do(req)
+	resp, err := sendRequest(client, req)
 	if err != nil {
 		return nil, err
 	}
@@ -725,8 +1179,7 @@ func GetRetweetAuthors(token string, uri string, limit int) (*RepostedBy, error)
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		bodyString := string(bodyBytes)
-		fmt.Println("Response Status:", resp.StatusCode)
-		fmt.Println("Response Body:", bodyString)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
 		return nil, errors.New("failed to fetch timeline")
 	}
 
@@ -737,3 +1190,461 @@ func GetRetweetAuthors(token string, uri string, limit int) (*RepostedBy, error)
 
 	return &retweetAuthors, nil
 }
+
+// https://docs.bsky.app/docs/api/app-bsky-graph-get-follows
+func GetFollows(ctx context.Context, token string, actor string, limit int, cursor string) (*Follows, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.graph.getFollows?limit=%d&actor=%s", limit, actor)
+	if cursor != "" {
+		url += "&cursor=" + cursor
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch follows")
+	}
+
+	follows := Follows{}
+	if err := json.NewDecoder(resp.Body).Decode(&follows); err != nil {
+		return nil, err
+	}
+
+	return &follows, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-feed-search-posts
+// An empty lang searches posts in every language.
+func SearchPosts(ctx context.Context, token string, query string, lang string, limit int, cursor string) (*SearchResults, error) {
+	appView, err := appViewURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("limit", fmt.Sprint(limit))
+	if lang != "" {
+		params.Set("lang", lang)
+	}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	url := appView + "/xrpc/app.bsky.feed.searchPosts?" + params.Encode()
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to search posts")
+	}
+
+	results := SearchResults{}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+
+	return &results, nil
+}
+
+// https://docs.bsky.app/docs/api/com-atproto-repo-list-records
+// Only the PDS the repo is on has its records, and they're public, so we go straight there without our token.
+func ListRecords(ctx context.Context, token string, repo string, collection string, limit int) (*RecordList, error) {
+	pds, err := ResolvePDS(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/com.atproto.repo.listRecords?limit=%d&repo=%s&collection=%s", limit, repo, collection)
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to list records")
+	}
+
+	records := RecordList{}
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, err
+	}
+
+	return &records, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-actor-get-suggestions
+func GetSuggestions(ctx context.Context, token string, limit int) (*Suggestions, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.actor.getSuggestions?limit=%d", limit)
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch suggestions")
+	}
+
+	suggestions := Suggestions{}
+	if err := json.NewDecoder(resp.Body).Decode(&suggestions); err != nil {
+		return nil, err
+	}
+
+	return &suggestions, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-graph-get-actor-starter-packs
+func GetActorStarterPacks(ctx context.Context, token string, actor string, limit int) (*StarterPacks, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.graph.getActorStarterPacks?limit=%d&actor=%s", limit, actor)
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch starter packs")
+	}
+
+	starterPacks := StarterPacks{}
+	if err := json.NewDecoder(resp.Body).Decode(&starterPacks); err != nil {
+		return nil, err
+	}
+
+	return &starterPacks, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-graph-get-starter-pack
+func GetStarterPack(ctx context.Context, token string, uri string) (*StarterPack, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/app.bsky.graph.getStarterPack?starterPack=" + uri
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch starter pack")
+	}
+
+	var starterPack struct {
+		StarterPack StarterPack `json:"starterPack"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&starterPack); err != nil {
+		return nil, err
+	}
+
+	return &starterPack.StarterPack, nil
+}
+
+// https://docs.bsky.app/docs/api/app-bsky-graph-get-list
+func GetList(ctx context.Context, token string, uri string, limit int) (*List, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/app.bsky.graph.getList?limit=%d&list=%s", limit, uri)
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch list")
+	}
+
+	list := List{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+// https://docs.bsky.app/docs/api/com-atproto-repo-get-record
+func GetRecord(ctx context.Context, token string, repo string, collection string, rkey string) (*Record, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + fmt.Sprintf("/xrpc/com.atproto.repo.getRecord?repo=%s&collection=%s&rkey=%s", repo, collection, rkey)
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		// This is how bluesky tells us that the record doesn't exist
+		var xrpcError XRPCError
+		if err := json.NewDecoder(resp.Body).Decode(&xrpcError); err == nil && xrpcError.Error == "RecordNotFound" {
+			return nil, ErrRecordNotFound
+		}
+		return nil, errors.New("failed to fetch record")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to fetch record")
+	}
+
+	record := Record{}
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// https://docs.bsky.app/docs/api/com-atproto-repo-put-record
+// If swapRecord is set, the write will only go through if the record's current CID still matches it.
+func PutRecord(ctx context.Context, token string, repo string, collection string, rkey string, record interface{}, swapRecord *string) (*CreateRecordResult, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/com.atproto.repo.putRecord"
+
+	payload := PutRecordPayload{
+		Repo:       repo,
+		Collection: collection,
+		RKey:       rkey,
+		Record:     record,
+		SwapRecord: swapRecord,
+	}
+
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.New("failed to marshal payload")
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		var xrpcError XRPCError
+		if err := json.NewDecoder(resp.Body).Decode(&xrpcError); err == nil && xrpcError.Error == "InvalidSwap" {
+			return nil, ErrInvalidSwap
+		}
+		return nil, errors.New("failed to put record: " + xrpcError.Message)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to put record: " + bodyString)
+	}
+
+	result := CreateRecordResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// UpdateProfile does a read-modify-write of the user's app.bsky.actor.profile record.
+// The record is kept as a map, so that we don't drop any fields we don't know about.
+// If someone else changes the profile in between our read & write, we try again.
+func UpdateProfile(ctx context.Context, token string, my_did string, update func(profile map[string]interface{}) error) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		profile := map[string]interface{}{
+			"$type": "app.bsky.actor.profile",
+		}
+		var swapRecord *string
+
+		record, err := GetRecord(ctx, token, my_did, "app.bsky.actor.profile", "self")
+		if err != nil && err != ErrRecordNotFound {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(record.Value, &profile); err != nil {
+				return err
+			}
+			swapRecord = &record.CID
+		}
+
+		if err := update(profile); err != nil {
+			return err
+		}
+
+		_, err = PutRecord(ctx, token, my_did, "app.bsky.actor.profile", "self", profile, swapRecord)
+		if err == ErrInvalidSwap {
+			continue
+		}
+		return err
+	}
+	// It kept changing under us, so we give up & let the user try again
+	return ErrInvalidSwap
+}
+
+// https://docs.bsky.app/docs/api/com-atproto-repo-upload-blob
+func UploadBlob(ctx context.Context, token string, data []byte, mimeType string) (*Blob, error) {
+	pds, err := pdsURL(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	url := pds + "/xrpc/com.atproto.repo.uploadBlob"
+
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", mimeType)
+
+	resp, err := sendRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		bodyString := string(bodyBytes)
+		log.DebugContext(ctx, "Bluesky request failed", "status", resp.StatusCode, "body", bodyString)
+		return nil, errors.New("failed to upload blob")
+	}
+
+	var result struct {
+		Blob Blob `json:"blob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result.Blob, nil
+}
+
+// AvatarURL gets the CDN url of a user's avatar from it's blob CID
+func AvatarURL(did string, cid string) string {
+	return "https://cdn.bsky.app/img/avatar/plain/" + did + "/" + cid + "@jpeg"
+}
@@ -0,0 +1,378 @@
+package blueskyapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+)
+
+// Where logins go if we can't work out someone's PDS. bsky.social forwards requests to the right PDS for anyone hosted by bluesky.
+const defaultPDS = "https://bsky.social"
+
+// Where app.bsky.* requests without a token go.
+const publicAppView = "https://public.api.bsky.app"
+
+// How long we trust a PDS we looked up before looking it up again, in case the user moved.
+const pdsCacheTTL = time.Hour
+
+// The app view we ask the PDS to forward app.bsky.* requests to.
+const appViewProxy = "did:web:api.bsky.app#bsky_appview"
+
+type pdsCacheEntry struct {
+	pds     string
+	expires time.Time
+}
+
+var (
+	pdsCache      = map[string]pdsCacheEntry{}
+	pdsCacheMutex sync.Mutex
+)
+
+// https://atproto.com/specs/handle#handle-identifier-syntax
+var handleRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// TLDs that can't be used for handles, as they either aren't on the internet, or are only meant for examples.
+var disallowedHandleTLDs = []string{".alt", ".arpa", ".example", ".internal", ".invalid", ".local", ".localhost", ".onion"}
+
+// isValidHandle checks that a handle is a real domain name, before we go making requests to it.
+// This only checks the name. A real domain can still point at our own network, which publicOnlyTransport stops.
+func isValidHandle(handle string) bool {
+	if len(handle) > 253 || !handleRegex.MatchString(handle) {
+		return false
+	}
+	handle = strings.ToLower(handle)
+	for _, tld := range disallowedHandleTLDs {
+		if strings.HasSuffix(handle, tld) {
+			return false
+		}
+	}
+	return true
+}
+
+// Address ranges that publicAddress doesn't catch with net/netip, like carrier grade NAT.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddress checks that an IP is on the internet, and not on our own machine or network.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicOnly refuses connections to anything that isn't on the internet.
+// It's checked after DNS, so a domain that points at our network (or changes to after we check it) gets stopped too.
+func dialPublicOnly(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addr) {
+		return fmt.Errorf("refusing to connect to %s, as it isn't a public address", addr)
+	}
+	return nil
+}
+
+// publicOnlyTransport is used for anything that goes to an address someone else gave us, like handles, did:web & PDSes.
+// Without it, someone could get us to make requests to anywhere we can reach, like a host on our own network.
+// It doesn't use a proxy, as the proxy would be on our own network.
+var publicOnlyTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublicOnly,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// https://atproto.com/specs/did
+type DIDDocument struct {
+	ID          string       `json:"id"`
+	AlsoKnownAs []string     `json:"alsoKnownAs"`
+	Service     []DIDService `json:"service"`
+}
+
+type DIDService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// PDS gets the user's PDS from their DID document.
+// Anyone can write anything in their DID document, so we only accept HTTPS URLs on real domains.
+func (doc *DIDDocument) PDS() (string, error) {
+	for _, service := range doc.Service {
+		if (service.ID == "#atproto_pds" || service.ID == doc.ID+"#atproto_pds") && service.Type == "AtprotoPersonalDataServer" {
+			endpoint, err := url.Parse(service.ServiceEndpoint)
+			if err != nil || endpoint.Scheme != "https" || endpoint.Port() != "" || !isValidHandle(endpoint.Hostname()) || endpoint.User != nil {
+				return "", fmt.Errorf("DID document has an invalid PDS: %s", service.ServiceEndpoint)
+			}
+			return strings.TrimSuffix(service.ServiceEndpoint, "/"), nil
+		}
+	}
+	return "", errors.New("DID document has no PDS")
+}
+
+// https://atproto.com/specs/handle#handle-resolution
+// We try DNS first, then the HTTPS well-known endpoint.
+func ResolveHandle(ctx context.Context, handle string) (string, error) {
+	if !isValidHandle(handle) {
+		return "", fmt.Errorf("invalid handle %s", handle)
+	}
+
+	records, err := net.DefaultResolver.LookupTXT(ctx, "_atproto."+handle)
+	if err == nil {
+		for _, record := range records {
+			if did, ok := strings.CutPrefix(record, "did="); ok {
+				return did, nil
+			}
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: publicOnlyTransport}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+handle+"/.well-known/atproto-did", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve handle %s", handle)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	if err != nil {
+		return "", err
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") {
+		return "", fmt.Errorf("failed to resolve handle %s", handle)
+	}
+	return did, nil
+}
+
+// GetDIDDocument gets a DID document from plc.directory, or from the domain for did:web.
+func GetDIDDocument(ctx context.Context, did string) (*DIDDocument, error) {
+	var url string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		url = "https://plc.directory/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		// atproto only allows did:web on a plain domain, which follows the same rules as handles
+		domain := strings.TrimPrefix(did, "did:web:")
+		if !isValidHandle(domain) {
+			return nil, fmt.Errorf("invalid did:web: %s", did)
+		}
+		url = "https://" + domain + "/.well-known/did.json"
+	default:
+		return nil, fmt.Errorf("unsupported DID method: %s", did)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: publicOnlyTransport}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch DID document for %s", did)
+	}
+
+	doc := DIDDocument{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// ResolvePDS gets the PDS a DID is hosted on, using the cache if we've looked it up recently.
+func ResolvePDS(ctx context.Context, did string) (string, error) {
+	pdsCacheMutex.Lock()
+	entry, ok := pdsCache[did]
+	pdsCacheMutex.Unlock()
+	if ok && entry.expires.After(time.Now()) {
+		return entry.pds, nil
+	}
+
+	doc, err := GetDIDDocument(ctx, did)
+	if err != nil {
+		return "", err
+	}
+	pds, err := doc.PDS()
+	if err != nil {
+		return "", err
+	}
+
+	SetPDS(did, pds)
+	return pds, nil
+}
+
+// SetPDS puts a PDS we already know about (eg. from the DB) into the cache, so we don't have to look it up.
+func SetPDS(did string, pds string) {
+	pdsCacheMutex.Lock()
+	defer pdsCacheMutex.Unlock()
+
+	// Clean up everyone else's old entries while we're here
+	for otherDID, entry := range pdsCache {
+		if entry.expires.Before(time.Now()) {
+			delete(pdsCache, otherDID)
+		}
+	}
+
+	pdsCache[did] = pdsCacheEntry{
+		pds:     pds,
+		expires: time.Now().Add(pdsCacheTTL),
+	}
+}
+
+// resolveIdentifierPDS works out which PDS to log in to. Emails can't be resolved, so they go to the default PDS.
+func resolveIdentifierPDS(ctx context.Context, identifier string) string {
+	did := identifier
+	if !strings.HasPrefix(identifier, "did:") {
+		if strings.Contains(identifier, "@") {
+			return defaultPDS
+		}
+		resolvedDID, err := ResolveHandle(ctx, identifier)
+		if err != nil {
+			log.WarnContext(ctx, "Failed to resolve handle, using the default PDS", "handle", identifier, "error", err)
+			return defaultPDS
+		}
+		did = resolvedDID
+	}
+
+	pds, err := ResolvePDS(ctx, did)
+	if err != nil {
+		log.WarnContext(ctx, "Failed to resolve PDS, using the default one", "did", did, "error", err)
+		return defaultPDS
+	}
+	return pds
+}
+
+// pdsURL gets the PDS that a token's requests should go to. Both access & refresh tokens say who they belong to.
+// If we can't work it out, we fail rather than guessing, as guessing wrong would send the token to someone else's server.
+func pdsURL(ctx context.Context, token string) (string, error) {
+	did, err := bridge.GetJWTTokenSubject(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to get DID from token: %w", err)
+	}
+
+	pds, err := ResolvePDS(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve PDS for %s: %w", did, err)
+	}
+	return pds, nil
+}
+
+// appViewURL gets where an app.bsky.* request should go. With a token, that's the user's PDS, which forwards it to the app view for us.
+// Without one, it goes straight to the public app view.
+func appViewURL(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return publicAppView, nil
+	}
+	return pdsURL(ctx, token)
+}
+
+// SessionPDS works out which PDS a new session is on.
+// We don't use the DID document sent back when logging in, as whoever we logged in to could have put anything in it.
+func SessionPDS(ctx context.Context, res *AuthResponse) (string, error) {
+	return pdsURL(ctx, res.AccessJwt)
+}
+
+// VerifySession checks that a new session really belongs to the account it says it does, and returns that account's DID document.
+// Anyone can run a PDS and log people in to it, so we look the DID up ourselves, and make sure it's hosted where we logged in.
+// The default PDS is the exception, as it's an entryway which logs people in for accounts hosted elsewhere.
+func VerifySession(ctx context.Context, res *AuthResponse) (*DIDDocument, error) {
+	sub, err := bridge.GetJWTTokenSubject(res.AccessJwt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DID from token: %w", err)
+	}
+	if sub != res.DID {
+		return nil, fmt.Errorf("%w: session is for %s, but its token is for %s", ErrIdentityMismatch, res.DID, sub)
+	}
+
+	doc, err := GetDIDDocument(ctx, res.DID)
+	if err != nil {
+		return nil, err
+	}
+	if doc.ID != res.DID {
+		return nil, fmt.Errorf("%w: DID document for %s is for %s", ErrIdentityMismatch, res.DID, doc.ID)
+	}
+	pds, err := doc.PDS()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIdentityMismatch, err)
+	}
+	if !sameHost(res.PDS, defaultPDS) && !sameHost(res.PDS, pds) {
+		return nil, fmt.Errorf("%w: %s is hosted on %s, but logged in on %s", ErrIdentityMismatch, res.DID, pds, res.PDS)
+	}
+
+	SetPDS(res.DID, pds)
+	return doc, nil
+}
+
+// VerifyHandle checks a handle both ways: that it resolves to the DID, and that the DID document claims it back.
+func VerifyHandle(ctx context.Context, doc *DIDDocument, handle string) error {
+	did, err := ResolveHandle(ctx, handle)
+	if err != nil {
+		return err
+	}
+	if did != doc.ID {
+		return fmt.Errorf("handle %s resolves to %s, not %s", handle, did, doc.ID)
+	}
+	for _, aka := range doc.AlsoKnownAs {
+		if strings.EqualFold(aka, "at://"+handle) {
+			return nil
+		}
+	}
+	return fmt.Errorf("DID document for %s doesn't claim the handle %s", doc.ID, handle)
+}
+
+// sameHost checks if two URLs are on the same host.
+func sameHost(a string, b string) bool {
+	aURL, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	bURL, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return aURL.Hostname() != "" && strings.EqualFold(aURL.Hostname(), bURL.Hostname())
+}
@@ -0,0 +1,93 @@
+package blueskyapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is what the server told us about our rate limit, from the ratelimit-* headers on the last response.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	Policy    string
+}
+
+var (
+	rateLimits      = map[string]RateLimit{}
+	rateLimitsMutex sync.Mutex
+)
+
+// sendRequest sends a request to an XRPC server, and keeps track of the rate limit headers that come back.
+// Every request to bluesky should go through this.
+func sendRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	// Requests go to whichever PDS the user's DID document says, which anyone can set.
+	if client.Transport == nil {
+		client.Transport = publicOnlyTransport
+	}
+
+	// Authenticated app view requests go through the user's PDS, which needs to know which app view to forward them to.
+	if req.Header.Get("Authorization") != "" && strings.HasPrefix(req.URL.Path, "/xrpc/app.bsky.") && req.URL.Host != "public.api.bsky.app" {
+		req.Header.Set("atproto-proxy", appViewProxy)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token != "" {
+		recordRateLimit(token, resp.Header)
+	}
+
+	return resp, nil
+}
+
+func recordRateLimit(token string, header http.Header) {
+	limit, err := strconv.Atoi(header.Get("ratelimit-limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("ratelimit-remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("ratelimit-reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	rateLimitsMutex.Lock()
+	defer rateLimitsMutex.Unlock()
+
+	// Access tokens don't last very long, so clean up the ones we won't hear about again.
+	now := time.Now()
+	for otherToken, rateLimit := range rateLimits {
+		if rateLimit.Reset.Before(now) {
+			delete(rateLimits, otherToken)
+		}
+	}
+
+	rateLimits[token] = RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+		Policy:    header.Get("ratelimit-policy"),
+	}
+}
+
+// GetRateLimit gets the last rate limit the server sent back for a token, if we've seen one that hasn't reset yet.
+func GetRateLimit(token string) *RateLimit {
+	rateLimitsMutex.Lock()
+	defer rateLimitsMutex.Unlock()
+
+	rateLimit, ok := rateLimits[token]
+	if !ok || rateLimit.Reset.Before(time.Now()) {
+		return nil
+	}
+	return &rateLimit
+}
@@ -110,6 +110,30 @@ func GetJWTTokenExpirationUnix(token string) (*float64, error) {
 	return &exp, nil
 }
 
+// GetJWTTokenSubject gets who a JWT token belongs to. For bluesky's tokens, this is the user's DID.
+func GetJWTTokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid JWT token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", err
+	}
+
+	sub, ok := claims["sub"].(string)
+	if !ok {
+		return "", errors.New("subject not found in token")
+	}
+	return sub, nil
+}
+
 // Base64URLEncode encodes the given string using base64 and returns the result as a URL-safe string
 func Base64URLEncode(input string) string {
 	base64 := base64.StdEncoding.EncodeToString([]byte(input))
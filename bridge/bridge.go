@@ -8,8 +8,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/Preloading/MastodonTwitterAPI/logging"
 )
 
+var log = logging.For("bridge")
+
 type Retweet struct {
 	Tweet
 	RetweetedStatus Tweet `json:"retweeted_status"`
@@ -48,6 +52,16 @@ type Tweet struct {
 	RetweetedStatus *Tweet `json:"retweeted_status,omitempty"`
 }
 
+// https://web.archive.org/web/20120516070129/https://dev.twitter.com/docs/error-codes-responses
+type TwitterError struct {
+	Message string `json:"message" xml:"message"`
+	Code    int    `json:"code" xml:"code"`
+}
+
+type TwitterErrors struct {
+	Errors []TwitterError `json:"errors" xml:"errors"`
+}
+
 type TwitterUser struct {
 	Name                      string `json:"name" xml:"name"`
 	ProfileSidebarBorderColor string `json:"profile_sidebar_border_color" xml:"profile_sidebar_border_color"`
@@ -99,12 +113,86 @@ type TwitterActivitiySummary struct {
 	RetweetsCount   int       `json:"retweeters_count"`
 }
 
+// An item in the activity tab (/i/activity/about_me.json & /i/activity/by_friends.json)
+// Sources are always users, while targets & target objects can be either tweets or users, depending on the action.
+type TwitterActivity struct {
+	Action            string        `json:"action"`
+	MaxPosition       string        `json:"max_position"`
+	MinPosition       string        `json:"min_position"`
+	CreatedAt         string        `json:"created_at"`
+	Sources           []TwitterUser `json:"sources"`
+	SourcesSize       int           `json:"sources_size"`
+	Targets           []interface{} `json:"targets"`
+	TargetsSize       int           `json:"targets_size"`
+	TargetObjects     []interface{} `json:"target_objects"`
+	TargetObjectsSize int           `json:"target_objects_size"`
+}
+
 type MediaSize struct {
 	W      int    `json:"w"`
 	Resize string `json:"resize"`
 	H      int    `json:"h"`
 }
 
+// The sizes twitter offered for each photo. These get used by help/configuration, the :size suffixes on our CDN proxy,
+// and the sizes on each tweet's media, so they all have to agree with each other.
+// https://web.archive.org/web/20120412055327/https://dev.twitter.com/docs/api/1/get/help/configuration
+var MediaSizes = map[string]MediaSize{
+	"thumb":  {W: 150, H: 150, Resize: "crop"},
+	"small":  {W: 340, H: 480, Resize: "fit"},
+	"medium": {W: 600, H: 1200, Resize: "fit"},
+	"large":  {W: 1024, H: 2048, Resize: "fit"},
+}
+
+// MediaSizesFor works out what size an image would be for each of the MediaSizes.
+// Images are never scaled up. If we don't know the size of the image, we just use the maximum size.
+func MediaSizesFor(width int, height int) map[string]MediaSize {
+	sizes := map[string]MediaSize{}
+	for name, size := range MediaSizes {
+		if size.Resize == "crop" || width <= 0 || height <= 0 {
+			sizes[name] = size
+			continue
+		}
+
+		w, h := width, height
+		if w > size.W {
+			h = h * size.W / w
+			w = size.W
+		}
+		if h > size.H {
+			w = w * size.H / h
+			h = size.H
+		}
+		sizes[name] = MediaSize{W: w, H: h, Resize: size.Resize}
+	}
+	return sizes
+}
+
+type HelpConfiguration struct {
+	CharactersReservedPerMedia int                  `json:"characters_reserved_per_media"`
+	MaxMediaPerUpload          int                  `json:"max_media_per_upload"`
+	PhotoSizeLimit             int                  `json:"photo_size_limit"`
+	PhotoSizes                 map[string]MediaSize `json:"photo_sizes"`
+	ShortURLLength             int                  `json:"short_url_length"`
+	ShortURLLengthHttps        int                  `json:"short_url_length_https"`
+	NonUsernamePaths           []string             `json:"non_username_paths"`
+}
+
+// https://web.archive.org/web/20121014095216/https://dev.twitter.com/docs/api/1/get/statuses/oembed
+type OEmbed struct {
+	CacheAge     string `json:"cache_age"`
+	URL          string `json:"url"`
+	ProviderURL  string `json:"provider_url"`
+	ProviderName string `json:"provider_name"`
+	AuthorName   string `json:"author_name"`
+	Version      string `json:"version"`
+	AuthorURL    string `json:"author_url"`
+	Type         string `json:"type"`
+	HTML         string `json:"html"`
+	Height       *int   `json:"height"`
+	Width        int    `json:"width"`
+}
+
 type Media struct {
 	ID            big.Int              `json:"id"`
 	IDStr         string               `json:"id_str"`
@@ -237,7 +325,7 @@ func BskyMsgToTwitterID(uri string, creationTime time.Time, retweetUserId *strin
 	if len(encodedIdStr) < 167 {
 		encodedIdStr = strings.Repeat("0", 167-len(encodedIdStr)) + encodedIdStr
 	} else if len(encodedIdStr) > 167 {
-		fmt.Println("Encoded ID exceeds 167 digits")
+		log.Warn("Encoded ID exceeds 167 digits", "uri", uri)
 	}
 
 	// Add the Unix timestamp at the start
@@ -288,7 +376,7 @@ func XMLEncoder(data interface{}, oldHeaderName string, newHeaderName string) (*
 	enc := xml.NewEncoder(&buf)
 	enc.Indent("", "  ")
 	if err := enc.Encode(data); err != nil {
-		fmt.Println("Error encoding XML:", err)
+		log.Error("Failed to encode XML", "error", err)
 		return nil, err
 	}
 
@@ -0,0 +1,64 @@
+package bridge
+
+import (
+	"strings"
+)
+
+// Twitter profiles have a location & a URL, which bluesky profiles don't have.
+// To keep them, we store them as the last lines of the bluesky description, like so:
+//
+//	Just a guy who likes old iPhones
+//
+//	📍 Toronto
+//	🔗 https://example.com
+//
+// This way they still make sense to anyone looking at the profile from bluesky.
+const (
+	ProfileLocationPrefix = "📍 "
+	ProfileURLPrefix      = "🔗 "
+)
+
+// BuildProfileDescription folds a twitter bio, location & url into a single bluesky description
+func BuildProfileDescription(bio string, location string, url string) string {
+	bio = strings.TrimRight(bio, " \n")
+	location = strings.TrimSpace(strings.ReplaceAll(location, "\n", " "))
+	url = strings.TrimSpace(strings.ReplaceAll(url, "\n", " "))
+
+	footer := []string{}
+	if location != "" {
+		footer = append(footer, ProfileLocationPrefix+location)
+	}
+	if url != "" {
+		footer = append(footer, ProfileURLPrefix+url)
+	}
+
+	if len(footer) == 0 {
+		return bio
+	}
+	if bio == "" {
+		return strings.Join(footer, "\n")
+	}
+	return bio + "\n\n" + strings.Join(footer, "\n")
+}
+
+// ParseProfileDescription splits a bluesky description back into the bio, location & url.
+// Descriptions that weren't made by BuildProfileDescription are returned as the bio.
+func ParseProfileDescription(description string) (bio string, location string, url string) {
+	lines := strings.Split(strings.TrimRight(description, " \n"), "\n")
+
+	i := len(lines)
+	for i > 0 {
+		line := lines[i-1]
+		if location == "" && strings.HasPrefix(line, ProfileLocationPrefix) {
+			location = strings.TrimPrefix(line, ProfileLocationPrefix)
+		} else if url == "" && strings.HasPrefix(line, ProfileURLPrefix) {
+			url = strings.TrimPrefix(line, ProfileURLPrefix)
+		} else {
+			break
+		}
+		i--
+	}
+
+	bio = strings.TrimRight(strings.Join(lines[:i], "\n"), " \n")
+	return bio, location, url
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/config"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"gorm.io/gorm"
+)
+
+// Admin commands, run as "<binary> <group> <command> [args]" instead of starting the server.
+// None of these need anyone's encryption key, so they can't see inside sessions, only manage them.
+type command struct {
+	usage       string
+	description string
+	run         func(cfg *config.Config, args []string) error
+}
+
+const (
+	listSessionsUsage         = "sessions list [did]"
+	inspectSessionUsage       = "sessions inspect <token uuid>"
+	revokeSessionsUsage       = "sessions revoke <token uuid> | sessions revoke -did <did>"
+	purgeMessageContextsUsage = "message-contexts purge [did]"
+	generateKeyUsage          = "keys generate"
+	rotateKeysUsage           = "keys rotate"
+	createInviteUsage         = "invites create [-uses n] [-expires duration] [-note text]"
+	listInvitesUsage          = "invites list"
+	revokeInviteUsage         = "invites revoke <code>"
+)
+
+var commands = map[string]map[string]command{
+	"sessions": {
+		"list": {
+			usage:       listSessionsUsage,
+			description: "List sessions, optionally only for one user",
+			run:         listSessions,
+		},
+		"inspect": {
+			usage:       inspectSessionUsage,
+			description: "Show everything we know about a session, apart from its tokens",
+			run:         inspectSession,
+		},
+		"revoke": {
+			usage:       revokeSessionsUsage,
+			description: "Revoke a session, or every session a user has",
+			run:         revokeSessions,
+		},
+	},
+	"message-contexts": {
+		"purge": {
+			usage:       purgeMessageContextsUsage,
+			description: "Remove stored timeline contexts, optionally only for one user",
+			run:         purgeMessageContexts,
+		},
+	},
+	"keys": {
+		"generate": {
+			usage:       generateKeyUsage,
+			description: "Print a new random key, for master_key or server_key",
+			run:         generateKey,
+		},
+		"rotate": {
+			usage:       rotateKeysUsage,
+			description: "Re-wrap every session with master_key, so old_master_keys can be removed",
+			run:         rotateKeys,
+		},
+	},
+	"invites": {
+		"create": {
+			usage:       createInviteUsage,
+			description: "Make an invite code, for when access_policy is \"invite\". -uses 0 means it can be used any number of times",
+			run:         createInvite,
+		},
+		"list": {
+			usage:       listInvitesUsage,
+			description: "List invite codes, and how much they've been used",
+			run:         listInvites,
+		},
+		"revoke": {
+			usage:       revokeInviteUsage,
+			description: "Delete an invite code. Anyone who already used it keeps access",
+			run:         revokeInvite,
+		},
+	},
+}
+
+// runCommand runs an admin command. It returns false if args isn't a command, so the server should start instead.
+func runCommand(cfg *config.Config, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			printUsage()
+			return true, nil
+		}
+		printUsage()
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if len(args) < 2 {
+		printUsage()
+		return true, fmt.Errorf("%s needs a command", args[0])
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		printUsage()
+		return true, fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+
+	return true, cmd.run(cfg, args[2:])
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  (no arguments)  Start the server")
+
+	groups := make([]string, 0, len(commands))
+	for group := range commands {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, group := range groups {
+		names := make([]string, 0, len(commands[group]))
+		for name := range commands[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %s\t%s\n", commands[group][name].usage, commands[group][name].description)
+		}
+	}
+	w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func formatUnixTime(unix float64) string {
+	t := time.Unix(int64(unix), 0)
+	return formatTime(&t)
+}
+
+func listSessions(cfg *config.Config, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: " + listSessionsUsage)
+	}
+	did := ""
+	if len(args) == 1 {
+		did = args[0]
+	}
+
+	sessions, err := db_controller.ListSessions(did)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN UUID\tDID\tCREATED\tLAST USED\tACCESS EXPIRES\tREFRESH EXPIRES")
+	for _, session := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", session.TokenUUID, session.UserDID, formatTime(session.CreatedAt), formatTime(session.LastUsedAt), formatUnixTime(session.AccessExpiry), formatUnixTime(session.RefreshExpiry))
+	}
+	return w.Flush()
+}
+
+func inspectSession(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: " + inspectSessionUsage)
+	}
+
+	session, err := db_controller.GetSession(args[0])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("no session with token uuid %s", args[0])
+	} else if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Token UUID:\t%s\n", session.TokenUUID)
+	fmt.Fprintf(w, "DID:\t%s\n", session.UserDID)
+	fmt.Fprintf(w, "PDS:\t%s\n", session.PDS)
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(session.CreatedAt))
+	fmt.Fprintf(w, "Last used:\t%s\n", formatTime(session.LastUsedAt))
+	fmt.Fprintf(w, "Access token expires:\t%s\n", formatUnixTime(session.AccessExpiry))
+	fmt.Fprintf(w, "Refresh token expires:\t%s\n", formatUnixTime(session.RefreshExpiry))
+	fmt.Fprintf(w, "Refreshes:\t%d\n", session.Version)
+	fmt.Fprintf(w, "Being refreshed until:\t%s\n", formatTime(session.RefreshingUntil))
+	fmt.Fprintf(w, "Background refresh:\t%t\n", session.WrappedEncryptionKey != "")
+	fmt.Fprintf(w, "Background refresh failures:\t%d\n", session.RefreshFailures)
+	if session.LastRefreshError != "" {
+		fmt.Fprintf(w, "Last refresh error:\t%s\n", session.LastRefreshError)
+	}
+	return w.Flush()
+}
+
+// revokeSessions deletes sessions from the DB, which makes their oauth tokens useless.
+// We can't log them out of bluesky, as that needs the refresh token, and that needs the encryption key.
+func revokeSessions(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	did := flags.String("did", "", "revoke every session this user has")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *did != "" {
+		if flags.NArg() != 0 {
+			return errors.New("usage: " + revokeSessionsUsage)
+		}
+		revoked, err := db_controller.DeleteUserSessions(*did)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %d sessions for %s\n", revoked, *did)
+		return nil
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: " + revokeSessionsUsage)
+	}
+	tokenUUID := flags.Arg(0)
+	session, err := db_controller.GetSession(tokenUUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("no session with token uuid %s", tokenUUID)
+	} else if err != nil {
+		return err
+	}
+	if err := db_controller.DeleteSession(session.UserDID, session.TokenUUID); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked session %s for %s\n", session.TokenUUID, session.UserDID)
+	return nil
+}
+
+func purgeMessageContexts(cfg *config.Config, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && !strings.HasPrefix(args[0], "did:")) {
+		return errors.New("usage: " + purgeMessageContextsUsage)
+	}
+	did := ""
+	if len(args) == 1 {
+		did = args[0]
+	}
+
+	purged, err := db_controller.PurgeMessageContexts(did)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d message contexts\n", purged)
+	return nil
+}
+
+func generateKey(cfg *config.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: " + generateKeyUsage)
+	}
+
+	key, err := bridge.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// rotateKeys moves every session over to the current master key. To change the master key, move the old one to old_master_keys,
+// set the new one, run this, then remove the old one. The server can keep running the whole time.
+func rotateKeys(cfg *config.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: " + rotateKeysUsage)
+	}
+
+	rotated, clientKeyOnly, err := db_controller.RotateMasterKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Re-wrapped %d sessions with the current master key\n", rotated)
+	if clientKeyOnly > 0 {
+		fmt.Printf("%d sessions are only encrypted with the client's key. They'll move to the master key the next time they're refreshed.\n", clientKeyOnly)
+	}
+	return nil
+}
+
+// generateInviteCode makes a random code that's easy to read out & type, like "abcde-fghij".
+func generateInviteCode() (string, error) {
+	random := make([]byte, 10)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(random))
+	return code[:5] + "-" + code[5:10], nil
+}
+
+func createInvite(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("invites create", flag.ContinueOnError)
+	uses := flags.Int("uses", 1, "how many people can use the code, 0 for unlimited")
+	expires := flags.Duration("expires", 0, "how long until the code expires, eg. 72h. Never if not set")
+	note := flags.String("note", "", "a note to remember who the code is for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *uses < 0 || *expires < 0 {
+		return errors.New("usage: " + createInviteUsage)
+	}
+
+	var expiresAt *time.Time
+	if *expires > 0 {
+		t := time.Now().Add(*expires)
+		expiresAt = &t
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		return err
+	}
+	if err := db_controller.CreateInvite(code, *uses, expiresAt, *note); err != nil {
+		return err
+	}
+	fmt.Println(code)
+	if cfg.AccessPolicy != "invite" {
+		fmt.Fprintf(os.Stderr, "Note: access_policy is %q, so invite codes aren't being asked for.\n", cfg.AccessPolicy)
+	}
+	return nil
+}
+
+func listInvites(cfg *config.Config, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: " + listInvitesUsage)
+	}
+
+	invites, err := db_controller.ListInvites()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tUSES\tEXPIRES\tCREATED\tNOTE")
+	for _, invite := range invites {
+		maxUses := "unlimited"
+		if invite.MaxUses > 0 {
+			maxUses = fmt.Sprint(invite.MaxUses)
+		}
+		fmt.Fprintf(w, "%s\t%d/%s\t%s\t%s\t%s\n", invite.Code, invite.Uses, maxUses, formatTime(invite.ExpiresAt), formatTime(invite.CreatedAt), invite.Note)
+	}
+	return w.Flush()
+}
+
+func revokeInvite(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: " + revokeInviteUsage)
+	}
+
+	deleted, err := db_controller.DeleteInvite(args[0])
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("no invite with code %s", args[0])
+	}
+	fmt.Printf("Revoked invite %s\n", args[0])
+	return nil
+}
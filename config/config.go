@@ -0,0 +1,214 @@
+// DO NOT EDIT THIS FILE!!!!!!!
+// Please edit the JSON file, or the enviorment variables to change the configuration.
+// This is for processing your configuration, and changing this can cause problems.
+
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+type Config struct {
+	// Accessible server address. If it's empty, we use the address each request was made to.
+	// OAuth signatures are checked against this, so only set it if a proxy changes the address clients use.
+	URL string `json:"address"`
+	// The port to run the server on
+	Port int `json:"port"`
+	// The feed generator that /1/statuses/public_timeline.json shows
+	PublicTimelineFeed string `json:"public_timeline_feed"`
+	// The domain usernames without one are assumed to be on, so "alice" logs in as "alice.bsky.social"
+	DefaultHandleDomain string `json:"default_handle_domain"`
+	// Lets the server refresh sessions in the background, so they don't expire if the app isn't opened for a while.
+	// This means keeping a copy of each session's encryption key, wrapped with ServerKey, so it's off by default.
+	BackgroundRefresh bool `json:"background_refresh"`
+	// A base64 encoded 256 bit key. Only needed for BackgroundRefresh.
+	ServerKey string `json:"server_key"`
+	// Where to serve /metrics, eg. "127.0.0.1:9090". It's kept off the main port so it isn't public. Empty turns it off.
+	MetricsAddress string `json:"metrics_address"`
+	// A base64 encoded 256 bit key that wraps the key each session's tokens are encrypted with, on top of the key in the client's token.
+	// Set either this or MasterKeyFile. Without one, sessions are only encrypted with the client's key.
+	MasterKey     string `json:"master_key"`
+	MasterKeyFile string `json:"master_key_file"`
+	// Master keys that have been rotated out. Keep them here until "keys rotate" has been run.
+	OldMasterKeys []string `json:"old_master_keys"`
+	// How much to log: "debug", "info", "warn" or "error"
+	LogLevel string `json:"log_level"`
+	// Log levels for specific packages, eg. {"bluesky": "debug"}
+	LogLevels map[string]string `json:"log_levels"`
+	// "text" or "json"
+	LogFormat string `json:"log_format"`
+	// Who can log in: "open" lets anyone in, "allowlist" only lets in the accounts below, and "invite" also lets in anyone with an invite code.
+	AccessPolicy string `json:"access_policy"`
+	// Accounts that are always let in. Handles & PDS hosts can start with "*." to match a whole domain.
+	AllowedDIDs     []string `json:"allowed_dids"`
+	AllowedHandles  []string `json:"allowed_handles"`
+	AllowedPDSHosts []string `json:"allowed_pds_hosts"`
+	// What to do with requests from consumer keys that aren't registered: "allow" lets them through without checking the signature, "deny" rejects them.
+	UnknownConsumers string `json:"unknown_consumers"`
+	// Consumer keys to register on startup, so their signatures can be checked
+	Consumers []Consumer `json:"consumers"`
+}
+
+type Consumer struct {
+	Key    string `json:"key"`
+	Secret string `json:"secret"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+}
+
+// Parse config from first environment variables, then the config.json file
+func ParseConfig() Config {
+    // Set default values
+    config := Config{
+        Port: 3000,
+        PublicTimelineFeed: "at://did:plc:z72i7hdynmk6r22z27h6tvur/app.bsky.feed.generator/whats-hot", // Bluesky's Discover feed
+        DefaultHandleDomain: "bsky.social",
+        UnknownConsumers: "allow",
+        LogLevel: "info",
+        LogFormat: "text",
+        AccessPolicy: "open",
+    }
+
+	// Read config from config.json file
+	file, err := os.Open("config.json")
+	if err == nil {
+		defer file.Close()
+		decoder := json.NewDecoder(file)
+		fileConfig := Config{}
+		if err := decoder.Decode(&fileConfig); err == nil {
+			if fileConfig.URL != "" {
+				config.URL = fileConfig.URL
+			}
+			if fileConfig.Port != 0 {
+				config.Port = fileConfig.Port
+			}
+			if fileConfig.PublicTimelineFeed != "" {
+				config.PublicTimelineFeed = fileConfig.PublicTimelineFeed
+			}
+			if fileConfig.DefaultHandleDomain != "" {
+				config.DefaultHandleDomain = fileConfig.DefaultHandleDomain
+			}
+			if fileConfig.UnknownConsumers != "" {
+				config.UnknownConsumers = fileConfig.UnknownConsumers
+			}
+			if fileConfig.LogLevel != "" {
+				config.LogLevel = fileConfig.LogLevel
+			}
+			if fileConfig.LogFormat != "" {
+				config.LogFormat = fileConfig.LogFormat
+			}
+			if fileConfig.AccessPolicy != "" {
+				config.AccessPolicy = fileConfig.AccessPolicy
+			}
+			config.AllowedDIDs = fileConfig.AllowedDIDs
+			config.AllowedHandles = fileConfig.AllowedHandles
+			config.AllowedPDSHosts = fileConfig.AllowedPDSHosts
+			config.LogLevels = fileConfig.LogLevels
+			config.Consumers = fileConfig.Consumers
+			config.BackgroundRefresh = fileConfig.BackgroundRefresh
+			config.ServerKey = fileConfig.ServerKey
+			config.MetricsAddress = fileConfig.MetricsAddress
+			config.MasterKey = fileConfig.MasterKey
+			config.MasterKeyFile = fileConfig.MasterKeyFile
+			config.OldMasterKeys = fileConfig.OldMasterKeys
+		}
+	}
+
+    // Get values from environment variables
+    if url := os.Getenv("SERVER_URL"); url != "" {
+        config.URL = url
+    }
+
+    if port := os.Getenv("SERVER_PORT"); port != "" {
+        if portInt, err := strconv.Atoi(port); err == nil {
+            config.Port = portInt
+        }
+    }
+
+    if feed := os.Getenv("PUBLIC_TIMELINE_FEED"); feed != "" {
+        config.PublicTimelineFeed = feed
+    }
+
+    if domain := os.Getenv("DEFAULT_HANDLE_DOMAIN"); domain != "" {
+        config.DefaultHandleDomain = domain
+    }
+
+    if backgroundRefresh := os.Getenv("BACKGROUND_REFRESH"); backgroundRefresh != "" {
+        if backgroundRefreshBool, err := strconv.ParseBool(backgroundRefresh); err == nil {
+            config.BackgroundRefresh = backgroundRefreshBool
+        }
+    }
+
+    if serverKey := os.Getenv("SERVER_KEY"); serverKey != "" {
+        config.ServerKey = serverKey
+    }
+
+    if metricsAddress := os.Getenv("METRICS_ADDRESS"); metricsAddress != "" {
+        config.MetricsAddress = metricsAddress
+    }
+
+    if masterKey := os.Getenv("MASTER_KEY"); masterKey != "" {
+        config.MasterKey = masterKey
+    }
+
+    if masterKeyFile := os.Getenv("MASTER_KEY_FILE"); masterKeyFile != "" {
+        config.MasterKeyFile = masterKeyFile
+    }
+
+    if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
+        config.LogLevel = logLevel
+    }
+
+    // Written like "bluesky=debug,twitterv1=warn"
+    if logLevels := os.Getenv("LOG_LEVELS"); logLevels != "" {
+        config.LogLevels = map[string]string{}
+        for _, pair := range strings.Split(logLevels, ",") {
+            if pkg, level, ok := strings.Cut(strings.TrimSpace(pair), "="); ok {
+                config.LogLevels[strings.TrimSpace(pkg)] = strings.TrimSpace(level)
+            }
+        }
+    }
+
+    if logFormat := os.Getenv("LOG_FORMAT"); logFormat != "" {
+        config.LogFormat = logFormat
+    }
+
+    if accessPolicy := os.Getenv("ACCESS_POLICY"); accessPolicy != "" {
+        config.AccessPolicy = accessPolicy
+    }
+
+    // These are comma separated
+    if allowedDIDs := os.Getenv("ALLOWED_DIDS"); allowedDIDs != "" {
+        config.AllowedDIDs = strings.Split(allowedDIDs, ",")
+    }
+
+    if allowedHandles := os.Getenv("ALLOWED_HANDLES"); allowedHandles != "" {
+        config.AllowedHandles = strings.Split(allowedHandles, ",")
+    }
+
+    if allowedPDSHosts := os.Getenv("ALLOWED_PDS_HOSTS"); allowedPDSHosts != "" {
+        config.AllowedPDSHosts = strings.Split(allowedPDSHosts, ",")
+    }
+
+    if unknownConsumers := os.Getenv("UNKNOWN_CONSUMERS"); unknownConsumers != "" {
+        config.UnknownConsumers = unknownConsumers
+    }
+
+    return config
+}
+
+// GetMasterKey gets the master key, reading it from MasterKeyFile if that's where it is.
+func (config *Config) GetMasterKey() (string, error) {
+	if config.MasterKeyFile == "" {
+		return config.MasterKey, nil
+	}
+
+	key, err := os.ReadFile(config.MasterKeyFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
\ No newline at end of file
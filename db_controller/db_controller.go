@@ -1,22 +1,37 @@
 package db_controller
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/logging"
 	"github.com/google/uuid"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
 )
 
+var log = logging.For("db_controller")
+
+// gormLogWriter sends GORM's logs through our logger, so they get redacted & leveled like everything else.
+type gormLogWriter struct{}
+
+func (gormLogWriter) Printf(format string, args ...interface{}) {
+	log.Warn(fmt.Sprintf(format, args...))
+}
+
 // I will most likely need to store auth tokens in a database, as I can only really get one auth related value from the user, and I can't change that value.
 // I will probably send the oauth token as:
 // {user did}/{generated uuid}/{encryptionkey}
 
 // Since the only way to detect if a user has logged out is "/1/account/push_destinations/destroy.xml", I do not have a reliable way to detect if a user has logged out.
+// (We do treat that request as a logout though, see DeleteSession)
 // I also don't wanna think what would happen if someone found my DB and stole it. Then a bunch of people would have their auth tokens stolen. Having the encryption key
 // lets me store the auth tokens where it's encrypted.
 
@@ -42,12 +57,27 @@ import (
 
 // Token represents the schema for the tokens table
 type Token struct {
-	UserDID               string  `gorm:"column:user_did"`
-	TokenUUID             string  `gorm:"column:token_uuid"`
-	EncryptedAccessToken  string  `gorm:"column:encrypted_access_token"`
-	EncryptedRefreshToken string  `gorm:"column:encrypted_refresh_token"`
-	AccessExpiry          float64 `gorm:"column:access_expiry"`
-	RefreshExpiry         float64 `gorm:"column:refresh_expiry"`
+	UserDID               string     `gorm:"column:user_did"`
+	TokenUUID             string     `gorm:"column:token_uuid"`
+	EncryptedAccessToken  string     `gorm:"column:encrypted_access_token"`
+	EncryptedRefreshToken string     `gorm:"column:encrypted_refresh_token"`
+	AccessExpiry          float64    `gorm:"column:access_expiry"`
+	RefreshExpiry         float64    `gorm:"column:refresh_expiry"`
+	PDS                   string     `gorm:"column:pds"` // The user's PDS, which every request for this session goes to
+	CreatedAt             *time.Time `gorm:"column:created_at;autoCreateTime"`
+	LastUsedAt            *time.Time `gorm:"column:last_used_at"` // Only accurate to lastUsedResolution, so we aren't writing on every request
+	// The row's data key, wrapped with the master key that has this ID. See envelope.go.
+	WrappedDataKey string `gorm:"column:wrapped_data_key"`
+	MasterKeyID    string `gorm:"column:master_key_id"`
+	// Bluesky only lets a refresh token be used once, so only one process can refresh a session at a time.
+	// Whoever bumps the version gets to refresh it, and the others wait until RefreshingUntil for the new tokens.
+	Version         int        `gorm:"column:version;not null;default:0"`
+	RefreshingUntil *time.Time `gorm:"column:refreshing_until"`
+	// Only set when background refresh is turned on. This is the session's encryption key, encrypted with the server's key.
+	WrappedEncryptionKey string `gorm:"column:wrapped_encryption_key"`
+	// How many background refreshes in a row have failed, and why the last one did
+	RefreshFailures  int    `gorm:"column:refresh_failures;not null;default:0"`
+	LastRefreshError string `gorm:"column:last_refresh_error"`
 }
 
 type MessageContext struct {
@@ -57,8 +87,74 @@ type MessageContext struct {
 	TimelineContext string `gorm:"column:timeline_context"`
 }
 
+// PushDestination is a device that registered itself for push notifications.
+// Each one is tied to the session it was registered with, so we know which session to end when it gets destroyed.
+type PushDestination struct {
+	UserDID     string `gorm:"column:user_did"`
+	TokenUUID   string `gorm:"column:token_uuid"`
+	UDID        string `gorm:"column:udid"`
+	Environment string `gorm:"column:environment"`
+}
+
+// UserSettings stores what the user set in /1/account/settings, as bluesky has nowhere to keep these.
+// Unlike the tokens, these aren't secret, so they aren't encrypted.
+type UserSettings struct {
+	UserDID            string `gorm:"column:user_did;uniqueIndex"`
+	Language           string `gorm:"column:language"`
+	TimeZoneName       string `gorm:"column:time_zone_name"`
+	TzinfoName         string `gorm:"column:tzinfo_name"`
+	SleepTimeEnabled   bool   `gorm:"column:sleep_time_enabled"`
+	SleepStartTime     *int   `gorm:"column:sleep_start_time"`
+	SleepEndTime       *int   `gorm:"column:sleep_end_time"`
+	TrendLocationWoeid int    `gorm:"column:trend_location_woeid"`
+}
+
+// RequestToken is a temporary token from the three legged OAuth flow (oauth/request_token -> oauth/authorize -> oauth/access_token).
+// Once the user logs in, the session we made for them is kept here, encrypted with a key that needs the verifier to work out,
+// until the client trades it in for an access token.
+type RequestToken struct {
+	Token            string    `gorm:"column:token"`
+	Callback         string    `gorm:"column:callback"`
+	EncryptedSession string    `gorm:"column:encrypted_session"`
+	ExpiresAt        time.Time `gorm:"column:expires_at"`
+}
+
+// Consumer is an app that has been registered with us, so we can check that requests really came from it.
+type Consumer struct {
+	Key    string `gorm:"column:consumer_key"`
+	Secret string `gorm:"column:consumer_secret"`
+	Name   string `gorm:"column:name"`
+	URL    string `gorm:"column:url"`
+}
+
+// InviteCode lets someone use an invite only instance. MaxUses of 0 means it can be used any number of times.
+type InviteCode struct {
+	Code      string     `gorm:"column:code"`
+	MaxUses   int        `gorm:"column:max_uses;not null;default:0"`
+	Uses      int        `gorm:"column:uses;not null;default:0"`
+	ExpiresAt *time.Time `gorm:"column:expires_at"`
+	Note      string     `gorm:"column:note"` // Who it was for, so admins can keep track
+	CreatedAt *time.Time `gorm:"column:created_at;autoCreateTime"`
+}
+
+// InviteRedemption remembers who has used an invite, so they don't need one again the next time they log in.
+type InviteRedemption struct {
+	UserDID    string     `gorm:"column:user_did;uniqueIndex"`
+	Code       string     `gorm:"column:code"`
+	RedeemedAt *time.Time `gorm:"column:redeemed_at;autoCreateTime"`
+}
+
+// ErrInviteInvalid is returned when an invite code doesn't exist, has expired, or has been used up.
+var ErrInviteInvalid = errors.New("invite code is invalid")
+
+// How often we bother updating a token's LastUsedAt
+const lastUsedResolution = time.Minute
+
 var db *gorm.DB
 
+// ErrWrongEncryptionKey is returned when a session can't be decrypted with the key we were given.
+var ErrWrongEncryptionKey = errors.New("wrong encryption key")
+
 func InitDB() {
 	// Ensure the directory exists
 	dbPath := "./db/twitterbridge.db"
@@ -69,7 +165,14 @@ func InitDB() {
 
 	// Initialize the database connection
 	var err error
-	db, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	db, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{
+		// Not finding something is normal for us, so it isn't worth logging
+		Logger: logger.New(gormLogWriter{}, logger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  logger.Warn,
+			IgnoreRecordNotFoundError: true,
+		}),
+	})
 	if err != nil {
 		panic("failed to connect database")
 	}
@@ -77,6 +180,20 @@ func InitDB() {
 	// Auto-migrate the schema
 	db.AutoMigrate(&Token{})
 	db.AutoMigrate(&MessageContext{})
+	// Saving settings used to be able to race, so any duplicates have to go before the unique index can be added. The newest ones win.
+	if db.Migrator().HasTable(&UserSettings{}) {
+		db.Exec("DELETE FROM user_settings WHERE rowid NOT IN (SELECT MAX(rowid) FROM user_settings GROUP BY user_did)")
+	}
+	db.AutoMigrate(&UserSettings{})
+	db.AutoMigrate(&PushDestination{})
+	db.AutoMigrate(&RequestToken{})
+	db.AutoMigrate(&Consumer{})
+	db.AutoMigrate(&InviteCode{})
+	// Redemptions used to be able to race, so any duplicates have to go before the unique index can be added.
+	if db.Migrator().HasTable(&InviteRedemption{}) {
+		db.Exec("DELETE FROM invite_redemptions WHERE rowid NOT IN (SELECT MIN(rowid) FROM invite_redemptions GROUP BY user_did)")
+	}
+	db.AutoMigrate(&InviteRedemption{})
 }
 
 // StoreToken stores an encrypted access token and refresh token in the database.
@@ -89,17 +206,18 @@ func InitDB() {
 // - encryptionKey: The key used to encrypt the tokens.
 // - accessExpiry: The expiry time of the access token.
 // - refreshExpiry: The expiry time of the refresh token.
+// - pds: The URL of the user's PDS.
 //
 // Returns:
 // - The UUID of the stored token.
 // - An error if the operation fails.
-func StoreToken(did string, accessToken string, refreshToken string, encryptionKey string, accessExpiry float64, refreshExpiry float64) (*string, error) {
+func StoreToken(did string, accessToken string, refreshToken string, encryptionKey string, accessExpiry float64, refreshExpiry float64, pds string) (*string, error) {
 	uuid, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
 
-	tokenUUID, err := UpdateToken(uuid.String(), did, accessToken, refreshToken, encryptionKey, accessExpiry, refreshExpiry)
+	tokenUUID, err := UpdateToken(uuid.String(), did, accessToken, refreshToken, encryptionKey, accessExpiry, refreshExpiry, pds)
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +225,12 @@ func StoreToken(did string, accessToken string, refreshToken string, encryptionK
 	return tokenUUID, nil
 }
 
-func UpdateToken(uuid string, did string, accessToken string, refreshToken string, encryptionKey string, accessExpiry float64, refreshExpiry float64) (*string, error) {
+func UpdateToken(uuid string, did string, accessToken string, refreshToken string, encryptionKey string, accessExpiry float64, refreshExpiry float64, pds string) (*string, error) {
+	encryptionKey, wrappedDataKey, masterKeyID, err := newRowKey(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
 	token := Token{
 		UserDID:   did,
 		TokenUUID: uuid,
@@ -125,8 +248,11 @@ func UpdateToken(uuid string, did string, accessToken string, refreshToken strin
 			}
 			return encryptedToken
 		}(),
-		AccessExpiry:  accessExpiry,
-		RefreshExpiry: refreshExpiry,
+		AccessExpiry:   accessExpiry,
+		RefreshExpiry:  refreshExpiry,
+		PDS:            pds,
+		WrappedDataKey: wrappedDataKey,
+		MasterKeyID:    masterKeyID,
 	}
 
 	if err := db.Where("user_did = ? AND token_uuid = ?", did, uuid).Assign(&token).FirstOrCreate(&token).Error; err != nil {
@@ -136,23 +262,118 @@ func UpdateToken(uuid string, did string, accessToken string, refreshToken strin
 	return &token.TokenUUID, nil
 }
 
-func GetToken(did string, tokenUUID string, encryptionKey string) (*string, *string, *float64, *float64, error) {
+func GetToken(did string, tokenUUID string, encryptionKey string) (*string, *string, *float64, *float64, *string, error) {
 	var token Token
 	if err := db.Where("user_did = ? AND token_uuid = ?", did, tokenUUID).First(&token).Error; err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, err
+	}
+
+	encryptionKey, err := rowKey(&token, encryptionKey)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 
 	accessToken, err := bridge.Decrypt(token.EncryptedAccessToken, encryptionKey)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, ErrWrongEncryptionKey
 	}
 
 	refreshToken, err := bridge.Decrypt(token.EncryptedRefreshToken, encryptionKey)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, nil, nil, ErrWrongEncryptionKey
+	}
+
+	return &accessToken, &refreshToken, &token.AccessExpiry, &token.RefreshExpiry, &token.PDS, nil
+}
+
+// GetTokenRefreshState gets what we need to know to refresh a session without racing anyone else.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+// Returns:
+// - The token's version.
+// - When the current refresh gives up, if someone is refreshing it.
+// - An error if the operation fails.
+func GetTokenRefreshState(did string, tokenUUID string) (int, *time.Time, error) {
+	var token Token
+	if err := db.Select("version", "refreshing_until").Where("user_did = ? AND token_uuid = ?", did, tokenUUID).First(&token).Error; err != nil {
+		return 0, nil, err
+	}
+
+	return token.Version, token.RefreshingUntil, nil
+}
+
+// ClaimTokenRefresh tries to become the one who refreshes a session.
+// This only works if nobody has changed the token since we read its version, and nobody else is refreshing it.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+// - version: The version of the token we read.
+// - lease: How long we have to finish refreshing, before someone else can try.
+// Returns:
+// - Whether we got to refresh it.
+// - An error if the operation fails.
+func ClaimTokenRefresh(did string, tokenUUID string, version int, lease time.Duration) (bool, error) {
+	now := time.Now()
+	result := db.Model(&Token{}).
+		Where("user_did = ? AND token_uuid = ? AND version = ? AND (refreshing_until IS NULL OR refreshing_until < ?)", did, tokenUUID, version, now).
+		Updates(map[string]interface{}{
+			"version":          gorm.Expr("version + 1"),
+			"refreshing_until": now.Add(lease),
+		})
+	if result.Error != nil {
+		return false, result.Error
 	}
 
-	return &accessToken, &refreshToken, &token.AccessExpiry, &token.RefreshExpiry, nil
+	return result.RowsAffected == 1, nil
+}
+
+// FinishTokenRefresh stores the tokens from a refresh we claimed with ClaimTokenRefresh, and lets everyone waiting on it carry on.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+// - accessToken: The new access token to be encrypted and stored.
+// - refreshToken: The new refresh token to be encrypted and stored.
+// - encryptionKey: The key used to encrypt the tokens.
+// - accessExpiry: The expiry time of the access token.
+// - refreshExpiry: The expiry time of the refresh token.
+func FinishTokenRefresh(did string, tokenUUID string, accessToken string, refreshToken string, encryptionKey string, accessExpiry float64, refreshExpiry float64) error {
+	// Every refresh gets a new data key, which also moves rows from before the master key over to it.
+	encryptionKey, wrappedDataKey, masterKeyID, err := newRowKey(encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	encryptedAccessToken, err := bridge.Encrypt(accessToken, encryptionKey)
+	if err != nil {
+		return err
+	}
+	encryptedRefreshToken, err := bridge.Encrypt(refreshToken, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	// The session works again, so clearing its failures lets the background refresh pick it back up if it had given up on it.
+	return db.Model(&Token{}).Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Updates(map[string]interface{}{
+		"encrypted_access_token":  encryptedAccessToken,
+		"encrypted_refresh_token": encryptedRefreshToken,
+		"access_expiry":           accessExpiry,
+		"refresh_expiry":          refreshExpiry,
+		"wrapped_data_key":        wrappedDataKey,
+		"master_key_id":           masterKeyID,
+		"version":                 gorm.Expr("version + 1"),
+		"refreshing_until":        nil,
+		"refresh_failures":        0,
+		"last_refresh_error":      "",
+	}).Error
+}
+
+// AbandonTokenRefresh gives up a refresh we claimed with ClaimTokenRefresh, so someone else can try straight away.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+func AbandonTokenRefresh(did string, tokenUUID string) error {
+	return db.Model(&Token{}).Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Update("refreshing_until", nil).Error
 }
 
 // SetTimelineContext stores or updates the message context in the database.
@@ -163,8 +384,7 @@ func GetToken(did string, tokenUUID string, encryptionKey string) (*string, *str
 // - timelineContext: The context of the timeline.
 // - encryptionKey: The key used to encrypt the context.
 func SetTimelineContext(did string, tokenUUID string, lastMessageId big.Int, timelineContext string, encryptionKey string) error {
-	fmt.Println("Last Message ID: " + lastMessageId.String())
-	fmt.Println("Decoded ID: " + bridge.TwitterIDToBlueSky(&lastMessageId))
+	log.Debug("Storing timeline context", "message_id", lastMessageId.String(), "uri", bridge.TwitterIDToBlueSky(&lastMessageId))
 	encryptedLastMessageId, err := bridge.Encrypt(lastMessageId.String(), encryptionKey)
 	if err != nil {
 		return err
@@ -190,6 +410,7 @@ func SetTimelineContext(did string, tokenUUID string, lastMessageId big.Int, tim
 }
 
 // GetMessageContext retrieves the message context from the database.
+// Clients either send the ID of the last message they saw, or one less than it, so we accept both.
 // Parameters:
 // - did: The decentralized identifier of the user.
 // - tokenUUID: The UUID of the token.
@@ -199,15 +420,25 @@ func SetTimelineContext(did string, tokenUUID string, lastMessageId big.Int, tim
 // - The timeline context.
 // - An error if the operation fails.
 func GetTimelineContext(did string, tokenUUID string, message_id big.Int, encryptionKey string) (*string, error) {
-	encryptedLastMessageId, err := bridge.Encrypt(message_id.String(), encryptionKey)
-	if err != nil {
+	// The message ID is encrypted with a random nonce, so we can't look it up directly, and have to decrypt it instead.
+	var messageContext MessageContext
+	if err := db.Where("user_did = ? AND token_uuid = ?", did, tokenUUID).First(&messageContext).Error; err != nil {
 		return nil, err
 	}
 
-	var messageContext MessageContext
-	if err := db.Where("user_did = ? AND token_uuid = ? AND message_id = ?", did, tokenUUID, encryptedLastMessageId).First(&messageContext).Error; err != nil {
+	lastMessageIdStr, err := bridge.Decrypt(messageContext.LastMessageId, encryptionKey)
+	if err != nil {
 		return nil, err
 	}
+	lastMessageId, ok := new(big.Int).SetString(lastMessageIdStr, 10)
+	if !ok {
+		return nil, errors.New("invalid stored message id")
+	}
+
+	difference := new(big.Int).Sub(lastMessageId, &message_id)
+	if difference.Cmp(big.NewInt(0)) != 0 && difference.Cmp(big.NewInt(1)) != 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
 
 	timelineContext, err := bridge.Decrypt(messageContext.TimelineContext, encryptionKey)
 	if err != nil {
@@ -216,3 +447,424 @@ func GetTimelineContext(did string, tokenUUID string, message_id big.Int, encryp
 
 	return &timelineContext, nil
 }
+
+// DefaultUserSettings are the settings for a user who has never changed them.
+func DefaultUserSettings(did string) UserSettings {
+	return UserSettings{
+		UserDID:            did,
+		Language:           "en",
+		TimeZoneName:       "Pacific Time (US & Canada)",
+		TzinfoName:         "America/Los_Angeles",
+		SleepTimeEnabled:   false,
+		SleepStartTime:     nil,
+		SleepEndTime:       nil,
+		TrendLocationWoeid: 1,
+	}
+}
+
+// GetUserSettings retrieves a user's settings from the database, or the default settings if they haven't set any.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// Returns:
+// - The user's settings.
+// - An error if the operation fails.
+func GetUserSettings(did string) (*UserSettings, error) {
+	var settings UserSettings
+	if err := db.Where("user_did = ?", did).First(&settings).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			settings = DefaultUserSettings(did)
+			return &settings, nil
+		}
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+// SetUserSettings stores or updates a user's settings in the database.
+// Parameters:
+// - settings: The settings to store. The user is taken from settings.UserDID.
+func SetUserSettings(settings UserSettings) error {
+	// Doing it in one statement means two first saves at once can't both add a row.
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_did"}},
+		UpdateAll: true,
+	}).Create(&settings).Error
+}
+
+// StorePushDestination stores or updates a device registered for push notifications.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token the device is using.
+// - udid: The device's identifier.
+// - oldUDID: The identifier the device used to have, if it changed. This registration gets replaced.
+// - environment: The push environment (production or sandbox) of the device.
+func StorePushDestination(did string, tokenUUID string, udid string, oldUDID string, environment string) error {
+	if oldUDID != "" && oldUDID != udid {
+		if err := db.Where("user_did = ? AND udid = ?", did, oldUDID).Delete(&PushDestination{}).Error; err != nil {
+			return err
+		}
+	}
+
+	pushDestination := PushDestination{
+		UserDID:     did,
+		TokenUUID:   tokenUUID,
+		UDID:        udid,
+		Environment: environment,
+	}
+
+	if err := db.Where("user_did = ? AND udid = ?", did, udid).Assign(&pushDestination).FirstOrCreate(&pushDestination).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteSession removes everything we have stored for a session: it's tokens, timeline contexts, and push destinations.
+// After this, the session's oauth token is useless.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+func DeleteSession(did string, tokenUUID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Delete(&Token{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Delete(&MessageContext{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Delete(&PushDestination{}).Error; err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// StoreRequestToken stores a new request token. Any request tokens that have expired get cleaned up at the same time.
+// Parameters:
+// - token: The request token.
+// - callback: Where to send the user after they log in, or "oob" to show them a PIN instead.
+// - expiresAt: When the request token stops working.
+func StoreRequestToken(token string, callback string, expiresAt time.Time) error {
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&RequestToken{}).Error; err != nil {
+		return err
+	}
+
+	return db.Create(&RequestToken{
+		Token:     token,
+		Callback:  callback,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// GetRequestToken retrieves a request token that hasn't expired yet.
+// Parameters:
+// - token: The request token.
+// Returns:
+// - The request token.
+// - An error if the operation fails, or gorm.ErrRecordNotFound if the token doesn't exist or has expired.
+func GetRequestToken(token string) (*RequestToken, error) {
+	var requestToken RequestToken
+	if err := db.Where("token = ? AND expires_at > ?", token, time.Now()).First(&requestToken).Error; err != nil {
+		return nil, err
+	}
+
+	return &requestToken, nil
+}
+
+// AuthorizeRequestToken stores the session that a request token will be traded in for.
+// A request token can only be authorized once, so a second login can't swap out the session the first one made.
+// Parameters:
+// - token: The request token.
+// - encryptedSession: The session, already encrypted.
+// Returns:
+// - An error if the operation fails, or gorm.ErrRecordNotFound if the token doesn't exist, has expired, or was already authorized.
+func AuthorizeRequestToken(token string, encryptedSession string) error {
+	result := db.Model(&RequestToken{}).Where("token = ? AND expires_at > ? AND encrypted_session = ''", token, time.Now()).Update("encrypted_session", encryptedSession)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ClaimRequestToken gets an authorized request token and deletes it, so that it can't be used again.
+// Only one caller can ever claim a token, even if several try at once.
+// Parameters:
+// - token: The request token.
+// Returns:
+// - The request token.
+// - An error if the operation fails, or gorm.ErrRecordNotFound if the token doesn't exist, has expired, isn't authorized, or was already claimed.
+func ClaimRequestToken(token string) (*RequestToken, error) {
+	// Deleting & reading it back in one statement means whoever deletes the row is the one that claimed it
+	var requestTokens []RequestToken
+	result := db.Clauses(clause.Returning{}).Where("token = ? AND expires_at > ? AND encrypted_session <> ''", token, time.Now()).Delete(&requestTokens)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 || len(requestTokens) != 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &requestTokens[0], nil
+}
+
+// StoreConsumer registers an app, or updates it if it's already registered.
+// Parameters:
+// - key: The app's consumer key.
+// - secret: The app's consumer secret.
+// - name: The name of the app.
+// - url: The app's website, which posts made with it link to.
+func StoreConsumer(key string, secret string, name string, url string) error {
+	consumer := Consumer{
+		Key:    key,
+		Secret: secret,
+		Name:   name,
+		URL:    url,
+	}
+
+	if err := db.Where("consumer_key = ?", key).Assign(&consumer).FirstOrCreate(&consumer).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetConsumer retrieves a registered app.
+// Parameters:
+// - key: The app's consumer key.
+// Returns:
+// - The app.
+// - An error if the operation fails, or gorm.ErrRecordNotFound if the app isn't registered.
+func GetConsumer(key string) (*Consumer, error) {
+	var consumer Consumer
+	if err := db.Where("consumer_key = ?", key).First(&consumer).Error; err != nil {
+		return nil, err
+	}
+
+	return &consumer, nil
+}
+
+// SetWrappedEncryptionKey stores a session's encryption key, wrapped with the server's key, so the session can be refreshed in the background.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+// - wrappedEncryptionKey: The encryption key, already encrypted with the server's key.
+func SetWrappedEncryptionKey(did string, tokenUUID string, wrappedEncryptionKey string) error {
+	return db.Model(&Token{}).Where("user_did = ? AND token_uuid = ?", did, tokenUUID).Update("wrapped_encryption_key", wrappedEncryptionKey).Error
+}
+
+// ClearWrappedEncryptionKeys forgets every wrapped encryption key, for when background refresh gets turned off.
+func ClearWrappedEncryptionKeys() error {
+	return db.Model(&Token{}).Where("wrapped_encryption_key <> ''").Update("wrapped_encryption_key", "").Error
+}
+
+// GetSessionsDueForRefresh gets the sessions that can be refreshed in the background, and whose refresh token expires soon.
+// Parameters:
+// - refreshBefore: Sessions with a refresh token that expires before this (unix time) are included.
+// - maxFailures: Sessions that have failed to refresh this many times in a row are left out.
+// Returns:
+// - The sessions. Their tokens are still encrypted.
+// - An error if the operation fails.
+func GetSessionsDueForRefresh(refreshBefore float64, maxFailures int) ([]Token, error) {
+	var tokens []Token
+	if err := db.Where("wrapped_encryption_key <> '' AND refresh_expiry < ? AND refresh_expiry > ? AND refresh_failures < ?", refreshBefore, float64(time.Now().Unix()), maxFailures).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// RecordRefreshResult keeps track of whether a background refresh worked.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+// - refreshErr: The error the refresh failed with, or nil if it worked.
+func RecordRefreshResult(did string, tokenUUID string, refreshErr error) error {
+	query := db.Model(&Token{}).Where("user_did = ? AND token_uuid = ?", did, tokenUUID)
+	if refreshErr == nil {
+		return query.Updates(map[string]interface{}{
+			"refresh_failures":   0,
+			"last_refresh_error": "",
+		}).Error
+	}
+
+	return query.Updates(map[string]interface{}{
+		"refresh_failures":   gorm.Expr("refresh_failures + 1"),
+		"last_refresh_error": refreshErr.Error(),
+	}).Error
+}
+
+// CountFailingSessions counts the sessions whose last background refresh failed.
+func CountFailingSessions() (int64, error) {
+	var count int64
+	if err := db.Model(&Token{}).Where("refresh_failures > 0").Count(&count).Error; err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// TouchToken records that a session was just used.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// - tokenUUID: The UUID of the token.
+func TouchToken(did string, tokenUUID string) error {
+	now := time.Now()
+	return db.Model(&Token{}).
+		Where("user_did = ? AND token_uuid = ? AND (last_used_at IS NULL OR last_used_at < ?)", did, tokenUUID, now.Add(-lastUsedResolution)).
+		Update("last_used_at", now).Error
+}
+
+// ListSessions gets sessions for the admin commands. The tokens in them are still encrypted.
+// Parameters:
+// - did: Only get this user's sessions, or everyone's if it's empty.
+func ListSessions(did string) ([]Token, error) {
+	query := db.Order("user_did, created_at")
+	if did != "" {
+		query = query.Where("user_did = ?", did)
+	}
+
+	var tokens []Token
+	if err := query.Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// GetSession gets a single session by its UUID, without needing to know who it belongs to. The tokens in it are still encrypted.
+// Parameters:
+// - tokenUUID: The UUID of the token.
+func GetSession(tokenUUID string) (*Token, error) {
+	var token Token
+	if err := db.Where("token_uuid = ?", tokenUUID).First(&token).Error; err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// DeleteUserSessions removes every session a user has, like DeleteSession does for one.
+// Parameters:
+// - did: The decentralized identifier of the user.
+// Returns:
+// - How many sessions were removed.
+// - An error if the operation fails.
+func DeleteUserSessions(did string) (int64, error) {
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("user_did = ?", did).Delete(&Token{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		if err := tx.Where("user_did = ?", did).Delete(&MessageContext{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_did = ?", did).Delete(&PushDestination{}).Error; err != nil {
+			return err
+		}
+		return nil
+	})
+
+	return deleted, err
+}
+
+// PurgeMessageContexts removes stored timeline contexts. Clients will just lose their place in the timeline.
+// Parameters:
+// - did: Only remove this user's contexts, or everyone's if it's empty.
+// Returns:
+// - How many were removed.
+// - An error if the operation fails.
+func PurgeMessageContexts(did string) (int64, error) {
+	query := db.Session(&gorm.Session{AllowGlobalUpdate: true})
+	if did != "" {
+		query = query.Where("user_did = ?", did)
+	}
+
+	result := query.Delete(&MessageContext{})
+	return result.RowsAffected, result.Error
+}
+
+// CreateInvite stores a new invite code.
+// Parameters:
+// - code: The invite code.
+// - maxUses: How many people can use it, or 0 for any number.
+// - expiresAt: When it stops working, or nil if it doesn't.
+// - note: Who it was for.
+func CreateInvite(code string, maxUses int, expiresAt *time.Time, note string) error {
+	return db.Create(&InviteCode{
+		Code:      code,
+		MaxUses:   maxUses,
+		ExpiresAt: expiresAt,
+		Note:      note,
+	}).Error
+}
+
+// ListInvites gets every invite code, newest first.
+func ListInvites() ([]InviteCode, error) {
+	var invites []InviteCode
+	if err := db.Order("created_at DESC").Find(&invites).Error; err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+// DeleteInvite removes an invite code. People who already used it keep their access.
+// Parameters:
+// - code: The invite code.
+// Returns:
+// - Whether there was an invite with that code.
+// - An error if the operation fails.
+func DeleteInvite(code string) (bool, error) {
+	result := db.Where("code = ?", code).Delete(&InviteCode{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// HasRedeemedInvite checks if a user has used an invite before.
+// Parameters:
+// - did: The decentralized identifier of the user.
+func HasRedeemedInvite(did string) (bool, error) {
+	var count int64
+	if err := db.Model(&InviteRedemption{}).Where("user_did = ?", did).Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// RedeemInvite uses up an invite code for a user. Users who have already redeemed an invite don't use up another one.
+// Parameters:
+// - code: The invite code.
+// - did: The decentralized identifier of the user.
+// Returns:
+// - ErrInviteInvalid if the code doesn't exist, has expired, or has been used up.
+func RedeemInvite(code string, did string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// The redemption goes in first, so if someone else redeemed an invite for this user at the same time, only one of them uses up a code.
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&InviteRedemption{UserDID: did, Code: code})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		// Checking & using the invite in one go means two people can't both take the last use.
+		result = tx.Model(&InviteCode{}).
+			Where("code = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)", code, time.Now()).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInviteInvalid
+		}
+		return nil
+	})
+}
@@ -0,0 +1,166 @@
+package db_controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+)
+
+// Tokens are encrypted with a key made from two halves: the client's key from their oauth token, and a data key that's random for each row.
+// The data key is stored wrapped with the server's master key. Neither the DB, the master key, or the client's token is enough on its own,
+// and the master key can be changed by re-wrapping the data keys, without needing anything from the client.
+// Rows from before there was a master key (or on instances without one) are encrypted with just the client's key.
+
+type masterKey struct {
+	id  string
+	key string
+}
+
+var (
+	currentMasterKey *masterKey
+	masterKeys       = map[string]masterKey{} // By ID, including the old ones, so rows that haven't been rotated yet still work
+)
+
+var errMasterKeyMissing = errors.New("this session needs a master key that isn't configured")
+
+// masterKeyID identifies a master key without giving it away, so each row can say which key wrapped it.
+func masterKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SetMasterKeys sets the master key new rows get wrapped with, and the old keys rows might still be wrapped with.
+// The current key can be empty, in which case new rows are encrypted with just the client's key.
+// Parameters:
+// - current: The base64 encoded 256 bit master key.
+// - old: Master keys that have been rotated out.
+func SetMasterKeys(current string, old []string) error {
+	keys := map[string]masterKey{}
+	for _, key := range append(old, current) {
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("master key isn't valid base64: %w", err)
+		}
+		if len(decoded) != 32 {
+			return fmt.Errorf("master key must be 32 bytes, not %d", len(decoded))
+		}
+		keys[masterKeyID(key)] = masterKey{id: masterKeyID(key), key: key}
+	}
+
+	masterKeys = keys
+	currentMasterKey = nil
+	if current != "" {
+		key := keys[masterKeyID(current)]
+		currentMasterKey = &key
+	}
+	return nil
+}
+
+// combineKeys makes the key a row is actually encrypted with, from its data key and the client's key.
+func combineKeys(dataKey string, encryptionKey string) string {
+	mac := hmac.New(sha256.New, []byte(dataKey))
+	mac.Write([]byte(encryptionKey))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newRowKey makes a new data key for a row, wrapped with the current master key.
+// Returns:
+// - The key to encrypt the row's tokens with.
+// - The wrapped data key and the master key's ID, to store with the row. These are empty if there is no master key.
+// - An error if the operation fails.
+func newRowKey(encryptionKey string) (string, string, string, error) {
+	if currentMasterKey == nil {
+		return encryptionKey, "", "", nil
+	}
+
+	dataKey, err := bridge.GenerateKey()
+	if err != nil {
+		return "", "", "", err
+	}
+	wrappedDataKey, err := bridge.Encrypt(dataKey, currentMasterKey.key)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return combineKeys(dataKey, encryptionKey), wrappedDataKey, currentMasterKey.id, nil
+}
+
+// rowKey works out the key a stored row's tokens are encrypted with.
+func rowKey(token *Token, encryptionKey string) (string, error) {
+	if token.WrappedDataKey == "" {
+		return encryptionKey, nil
+	}
+
+	key, ok := masterKeys[token.MasterKeyID]
+	if !ok {
+		return "", errMasterKeyMissing
+	}
+	dataKey, err := bridge.Decrypt(token.WrappedDataKey, key.key)
+	if err != nil {
+		return "", err
+	}
+
+	return combineKeys(dataKey, encryptionKey), nil
+}
+
+// RotateMasterKey re-wraps every row's data key with the current master key. This only needs the master keys, so users don't have to do anything.
+// Rows that only use the client's key can't be upgraded here. They get a data key the next time they're refreshed.
+// Returns:
+// - How many rows were re-wrapped.
+// - How many rows only use the client's key.
+// - An error if the operation fails.
+func RotateMasterKey() (int, int64, error) {
+	if currentMasterKey == nil {
+		return 0, 0, errors.New("no master key is configured")
+	}
+
+	var tokens []Token
+	if err := db.Select("user_did", "token_uuid", "wrapped_data_key", "master_key_id").
+		Where("wrapped_data_key <> '' AND master_key_id <> ?", currentMasterKey.id).
+		Find(&tokens).Error; err != nil {
+		return 0, 0, err
+	}
+
+	rotated := 0
+	for _, token := range tokens {
+		oldKey, ok := masterKeys[token.MasterKeyID]
+		if !ok {
+			return rotated, 0, fmt.Errorf("session %s is wrapped with master key %s, which isn't configured", token.TokenUUID, token.MasterKeyID)
+		}
+		dataKey, err := bridge.Decrypt(token.WrappedDataKey, oldKey.key)
+		if err != nil {
+			return rotated, 0, err
+		}
+		wrappedDataKey, err := bridge.Encrypt(dataKey, currentMasterKey.key)
+		if err != nil {
+			return rotated, 0, err
+		}
+
+		// Only swap it if nobody else has changed the row since we read it, eg. by refreshing it with a new data key.
+		result := db.Model(&Token{}).
+			Where("user_did = ? AND token_uuid = ? AND wrapped_data_key = ?", token.UserDID, token.TokenUUID, token.WrappedDataKey).
+			Updates(map[string]interface{}{
+				"wrapped_data_key": wrappedDataKey,
+				"master_key_id":    currentMasterKey.id,
+			})
+		if result.Error != nil {
+			return rotated, 0, result.Error
+		}
+		rotated += int(result.RowsAffected)
+	}
+
+	var clientKeyOnly int64
+	if err := db.Model(&Token{}).Where("wrapped_data_key = '' OR wrapped_data_key IS NULL").Count(&clientKeyOnly).Error; err != nil {
+		return rotated, 0, err
+	}
+
+	return rotated, clientKeyOnly, nil
+}
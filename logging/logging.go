@@ -0,0 +1,147 @@
+// Package logging sets up the structured logger every package logs through.
+// Each package gets its own logger, so the log level can be turned up for just the part being debugged.
+// Anything that looks like a secret gets redacted before it's written, so logs can be shared safely.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	baseHandler atomic.Pointer[slog.Handler]
+
+	defaultLevel  = new(slog.LevelVar)
+	packageLevels = map[string]*slog.LevelVar{}
+	levelsMutex   sync.Mutex
+)
+
+func init() {
+	setOutput(os.Stdout, "text")
+}
+
+func setOutput(w io.Writer, format string) {
+	options := &slog.HandlerOptions{
+		Level:       slog.LevelDebug, // Levels are checked per package, before it gets here
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+	baseHandler.Store(&handler)
+}
+
+// ParseLevel parses a level name, like "debug" or "warn".
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Setup configures logging. It can be called after packages have made their loggers.
+// Parameters:
+// - level: The level for packages that don't have their own.
+// - levels: Levels for specific packages, eg. {"bluesky": "debug"}.
+// - format: "text" or "json".
+func Setup(level string, levels map[string]string, format string) error {
+	parsedDefault, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	parsedLevels := map[string]slog.Level{}
+	for pkg, name := range levels {
+		parsed, err := ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", pkg, err)
+		}
+		parsedLevels[pkg] = parsed
+	}
+
+	setOutput(os.Stdout, format)
+
+	levelsMutex.Lock()
+	defer levelsMutex.Unlock()
+
+	defaultLevel.Set(parsedDefault)
+	for _, levelVar := range packageLevels {
+		levelVar.Set(parsedDefault)
+	}
+	for pkg, parsed := range parsedLevels {
+		levelVar, ok := packageLevels[pkg]
+		if !ok {
+			levelVar = new(slog.LevelVar)
+			packageLevels[pkg] = levelVar
+		}
+		levelVar.Set(parsed)
+	}
+	return nil
+}
+
+// For gets the logger for a package.
+func For(pkg string) *slog.Logger {
+	levelsMutex.Lock()
+	levelVar, ok := packageLevels[pkg]
+	if !ok {
+		levelVar = new(slog.LevelVar)
+		levelVar.Set(defaultLevel.Level())
+		packageLevels[pkg] = levelVar
+	}
+	levelsMutex.Unlock()
+
+	return slog.New(&packageHandler{level: levelVar}).With("package", pkg)
+}
+
+// packageHandler filters by the package's level, then hands off to whichever handler Setup made.
+// Attributes & groups are kept until then, as the handler they go on might not exist yet.
+type packageHandler struct {
+	level *slog.LevelVar
+	ops   []func(slog.Handler) slog.Handler
+}
+
+func (h *packageHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *packageHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := *baseHandler.Load()
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("request_id", requestID)})
+	}
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *packageHandler) with(op func(slog.Handler) slog.Handler) *packageHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &packageHandler{level: h.level, ops: append(ops, op)}
+}
+
+func (h *packageHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *packageHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+type requestIDKey struct{}
+
+// WithRequestID adds a request ID to a context. Anything logged with the context gets tagged with it.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
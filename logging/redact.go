@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Attributes with these keys never get logged, whatever they look like.
+var sensitiveKeys = map[string]bool{
+	"authorization":      true,
+	"oauth_token":        true,
+	"oauth_token_secret": true,
+	"oauth_verifier":     true,
+	"oauth_signature":    true,
+	"x_auth_password":    true,
+	"password":           true,
+	"access_jwt":         true,
+	"refresh_jwt":        true,
+	"encryption_key":     true,
+	"dm_text":            true, // Direct message content
+}
+
+// Secrets that can turn up inside other strings, like URLs, headers & response bodies.
+var (
+	jwtRegex         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	bridgeTokenRegex = regexp.MustCompile(`tb\d+\.[A-Za-z0-9_.-]+`)
+	legacyTokenRegex = regexp.MustCompile(`ZGlkOn[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`) // "b64(DID).b64(UUID).key", where the DID always starts with "did:"
+	// key=value, key="value" & "key":"value"
+	sensitiveParamRegex = regexp.MustCompile(`(?i)("?(?:oauth_token|oauth_token_secret|oauth_verifier|oauth_signature|x_auth_password|password|accessJwt|refreshJwt)"?\s*[=:]\s*"?)([^"&,\s]+)`)
+	bearerRegex         = regexp.MustCompile(`(?i)(Bearer\s+)\S+`)
+)
+
+// Redact removes anything that looks like a secret from a string.
+func Redact(s string) string {
+	s = sensitiveParamRegex.ReplaceAllString(s, "${1}"+redacted)
+	s = bearerRegex.ReplaceAllString(s, "${1}"+redacted)
+	s = jwtRegex.ReplaceAllString(s, redacted)
+	s = bridgeTokenRegex.ReplaceAllString(s, redacted)
+	s = legacyTokenRegex.ReplaceAllString(s, redacted)
+	return s
+}
+
+// redactAttr is the slog ReplaceAttr hook that redacts every attribute before it's written.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, Redact(value.Error()))
+		case []byte:
+			return slog.String(attr.Key, Redact(string(value)))
+		case interface{ String() string }:
+			return slog.String(attr.Key, Redact(value.String()))
+		}
+	}
+	return attr
+}
@@ -1,11 +1,43 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/Preloading/MastodonTwitterAPI/config"
 	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/Preloading/MastodonTwitterAPI/logging"
 	"github.com/Preloading/MastodonTwitterAPI/twitterv1"
 )
 
 func main() {
+	cfg := config.ParseConfig()
+	if err := logging.Setup(cfg.LogLevel, cfg.LogLevels, cfg.LogFormat); err != nil {
+		panic("invalid log config: " + err.Error())
+	}
 	db_controller.InitDB()
-	twitterv1.InitServer()
+
+	masterKey, err := cfg.GetMasterKey()
+	if err != nil {
+		panic("failed to read master key: " + err.Error())
+	}
+	if err := db_controller.SetMasterKeys(masterKey, cfg.OldMasterKeys); err != nil {
+		panic(err)
+	}
+
+	if ran, err := runCommand(&cfg, os.Args[1:]); ran {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, consumer := range cfg.Consumers {
+		if err := db_controller.StoreConsumer(consumer.Key, consumer.Secret, consumer.Name, consumer.URL); err != nil {
+			panic("failed to register consumer " + consumer.Key)
+		}
+	}
+
+	twitterv1.InitServer(&cfg)
 }
@@ -0,0 +1,225 @@
+package twitterv1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Who can log in to this instance, from the access_policy config option.
+const (
+	accessPolicyOpen      = "open"
+	accessPolicyAllowlist = "allowlist"
+	accessPolicyInvite    = "invite"
+)
+
+var (
+	errAccessDenied   = errors.New("account isn't allowed on this instance")
+	errInviteRequired = errors.New("an invite code is required")
+)
+
+// The page users redeem an invite code on, for clients that log in with xAuth and can't ask for one.
+var invitePageTemplate = template.Must(template.New("invite").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Redeem an invite</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; background: #C0DEED; margin: 0; padding: 20px; }
+.box { background: #fff; max-width: 400px; margin: 40px auto; padding: 20px; border-radius: 6px; }
+input[type=text], input[type=password] { width: 100%; box-sizing: border-box; padding: 8px; margin: 4px 0 12px; }
+.error { color: #c00; }
+</style>
+</head>
+<body>
+<div class="box">
+{{if .Redeemed}}
+<h2>You're in</h2>
+<p>Your invite has been redeemed. Go back to the app and log in.</p>
+{{else}}
+<h2>Redeem an invite</h2>
+<p>This server is invite only. Log in with your Bluesky account to redeem your invite code.</p>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/invite">
+<label>Invite code<input type="text" name="invite_code" value="{{.InviteCode}}" autocapitalize="off" autocorrect="off"></label>
+<label>Handle or email<input type="text" name="handle" value="{{.Handle}}" placeholder="you.bsky.social" autocapitalize="off" autocorrect="off"></label>
+<label>Password<input type="password" name="password"></label>
+<p><small>We recommend using an app password from Settings &rarr; Privacy and security &rarr; App passwords.</small></p>
+<input type="submit" value="Redeem invite">
+</form>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+type invitePage struct {
+	InviteCode string
+	Handle     string
+	Error      string
+	Redeemed   bool
+}
+
+func renderInvitePage(c *fiber.Ctx, status int, page invitePage) error {
+	var sb strings.Builder
+	if err := invitePageTemplate.Execute(&sb, page); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).SendString(sb.String())
+}
+
+// checkAccessPolicy makes sure the access policy is one we know, so a typo doesn't leave the instance open.
+func checkAccessPolicy(policy string) error {
+	switch policy {
+	case accessPolicyOpen, accessPolicyAllowlist, accessPolicyInvite:
+		return nil
+	default:
+		return fmt.Errorf("unknown access_policy %q", policy)
+	}
+}
+
+// matchesDomain checks a handle or host against a list, where entries starting with "*." match any subdomain.
+func matchesDomain(domain string, patterns []string) bool {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(domain, suffix) {
+			return true
+		}
+		if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowlisted checks if an account is on the allowlist, by its DID, handle, or the PDS it's on.
+// doc has to be the DID document we looked up ourselves, not the one sent back when logging in.
+func isAllowlisted(ctx context.Context, res *blueskyapi.AuthResponse, doc *blueskyapi.DIDDocument) bool {
+	for _, did := range configData.AllowedDIDs {
+		if strings.TrimSpace(did) == res.DID {
+			return true
+		}
+	}
+	if matchesDomain(res.Handle, configData.AllowedHandles) {
+		err := blueskyapi.VerifyHandle(ctx, doc, res.Handle)
+		if err == nil {
+			return true
+		}
+		log.WarnContext(ctx, "Handle on the allowlist didn't verify", "did", res.DID, "handle", res.Handle, "error", err)
+	}
+	if len(configData.AllowedPDSHosts) > 0 {
+		if docPDS, err := doc.PDS(); err == nil {
+			if pds, err := url.Parse(docPDS); err == nil && matchesDomain(pds.Hostname(), configData.AllowedPDSHosts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAccess decides if someone who just logged in to bluesky can use this instance.
+// If they give an invite code and need one, it gets used up here.
+func checkAccess(ctx context.Context, res *blueskyapi.AuthResponse, inviteCode string) error {
+	// Even open instances need to know the session is who it says it is, as sessions & settings are stored by DID.
+	doc, err := blueskyapi.VerifySession(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	switch configData.AccessPolicy {
+	case accessPolicyOpen:
+		return nil
+	case accessPolicyAllowlist:
+		if isAllowlisted(ctx, res, doc) {
+			return nil
+		}
+		return errAccessDenied
+	case accessPolicyInvite:
+		if isAllowlisted(ctx, res, doc) {
+			return nil
+		}
+		redeemed, err := db_controller.HasRedeemedInvite(res.DID)
+		if err != nil {
+			return err
+		}
+		if redeemed {
+			return nil
+		}
+		if inviteCode == "" {
+			return errInviteRequired
+		}
+		return db_controller.RedeemInvite(strings.TrimSpace(inviteCode), res.DID)
+	default:
+		return errAccessDenied
+	}
+}
+
+// accessError works out what to tell the client when checkAccess fails.
+// Returns the message, the twitter error code, and the HTTP status.
+func accessError(c *fiber.Ctx, err error) (string, int, int) {
+	if errors.Is(err, blueskyapi.ErrIdentityMismatch) {
+		log.WarnContext(c.UserContext(), "Rejected a login that didn't match its identity", "error", err)
+		return "Could not verify which account you logged in to", errorCodeCouldNotAuthenticate, fiber.StatusUnauthorized
+	}
+
+	switch err {
+	case errAccessDenied:
+		return "This account isn't allowed to use this server", errorCodeAccessDenied, fiber.StatusForbidden
+	case errInviteRequired:
+		return "This server is invite only. Redeem an invite code at " + serverURL(c) + "/invite, then log in again.", errorCodeAccessDenied, fiber.StatusForbidden
+	case db_controller.ErrInviteInvalid:
+		return "That invite code is invalid, has expired, or has been used up", errorCodeAccessDenied, fiber.StatusForbidden
+	default:
+		log.ErrorContext(c.UserContext(), "Failed to check access", "error", err)
+		return "Internal error", errorCodeInternalError, fiber.StatusInternalServerError
+	}
+}
+
+// discardLogin logs out of a bluesky session we aren't going to keep.
+func discardLogin(c *fiber.Ctx, res *blueskyapi.AuthResponse) {
+	if err := blueskyapi.DeleteSession(c.UserContext(), res.RefreshJwt); err != nil {
+		log.WarnContext(c.UserContext(), "Failed to log out of bluesky", "error", err)
+	}
+}
+
+func InvitePage(c *fiber.Ctx) error {
+	return renderInvitePage(c, fiber.StatusOK, invitePage{InviteCode: c.Query("code")})
+}
+
+// RedeemInvite handles the form from InvitePage. We log in to prove the account is theirs, but don't keep the session.
+func RedeemInvite(c *fiber.Ctx) error {
+	inviteCode := strings.TrimSpace(c.FormValue("invite_code"))
+	handle := strings.TrimSpace(c.FormValue("handle"))
+	password := c.FormValue("password")
+
+	if inviteCode == "" || handle == "" || password == "" {
+		return renderInvitePage(c, fiber.StatusBadRequest, invitePage{InviteCode: inviteCode, Handle: handle, Error: "Enter your invite code, handle and password."})
+	}
+
+	res, err := blueskyLogin(c.UserContext(), handle, password)
+	if err != nil {
+		message, _, status := loginError(c.UserContext(), err)
+		if err == blueskyapi.ErrInvalidCredentials {
+			message = "Your handle or password is incorrect."
+		}
+		return renderInvitePage(c, status, invitePage{InviteCode: inviteCode, Handle: handle, Error: message})
+	}
+	defer discardLogin(c, res)
+
+	if err := checkAccess(c.UserContext(), res, inviteCode); err != nil {
+		message, _, status := accessError(c, err)
+		return renderInvitePage(c, status, invitePage{InviteCode: inviteCode, Handle: handle, Error: message})
+	}
+
+	return renderInvitePage(c, fiber.StatusOK, invitePage{Redeemed: true})
+}
@@ -0,0 +1,276 @@
+package twitterv1
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Bluesky doesn't have anything like the "By friends" tab, so we build it ourselves.
+// This means fetching things from a lot of different accounts, so we limit how many accounts we look at, and cache the result.
+const (
+	activityFriendFanout   = 10              // How many of the most recently followed accounts we look at
+	activityItemsPerFriend = 5               // How many likes & follows we fetch from each of them
+	activityCacheTTL       = 2 * time.Minute // How long until we rebuild a user's activity
+)
+
+type activityCacheEntry struct {
+	activities []bridge.TwitterActivity
+	expires    time.Time
+}
+
+var (
+	activityCache      = map[string]activityCacheEntry{}
+	activityCacheMutex sync.Mutex
+)
+
+// An activity before it gets turned into the twitter format
+type pendingActivity struct {
+	action    string
+	createdAt time.Time
+	sources   []blueskyapi.Author
+	post      *blueskyapi.Post
+	users     []string // DIDs of the targets, for follows
+}
+
+// This request is an "internal" request, and thus, these are very little to no docs.
+// It appears to return the same format as /i/activity/about_me.json, except the sources are the people you follow.
+// Bluesky has nothing like this, so it only covers retweets on the home timeline, and the latest likes & follows of the accounts you most recently followed.
+func ActivityByFriends(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	count := 20
+	if countStr := c.Query("count"); countStr != "" {
+		if parsedCount, err := strconv.Atoi(countStr); err == nil && parsedCount > 0 {
+			count = parsedCount
+		}
+	}
+
+	activityCacheMutex.Lock()
+	entry, ok := activityCache[*user_did]
+	activityCacheMutex.Unlock()
+
+	if !ok || entry.expires.Before(time.Now()) {
+		activities, err := buildFriendsActivity(c.UserContext(), *oauthToken, *user_did)
+		if err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to fetch activity", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch activity")
+		}
+
+		entry = activityCacheEntry{
+			activities: activities,
+			expires:    time.Now().Add(activityCacheTTL),
+		}
+		activityCacheMutex.Lock()
+		// Clean up everyone else's expired activity while we're here, so users we don't see again don't stick around
+		for did, otherEntry := range activityCache {
+			if otherEntry.expires.Before(time.Now()) {
+				delete(activityCache, did)
+			}
+		}
+		activityCache[*user_did] = entry
+		activityCacheMutex.Unlock()
+	}
+
+	activities := entry.activities
+	if len(activities) > count {
+		activities = activities[:count]
+	}
+
+	return c.JSON(activities)
+}
+
+// buildFriendsActivity approximates what the people a user follows have been up to.
+// Retweets come from the home timeline, while likes and follows come from the records of the most recently followed accounts.
+// This means we only see the last few likes & follows of a few friends, rather than everything everyone we follow has done.
+func buildFriendsActivity(ctx context.Context, token string, my_did string) ([]bridge.TwitterActivity, error) {
+	follows, err := blueskyapi.GetFollows(ctx, token, my_did, activityFriendFanout, "")
+	if err != nil {
+		return nil, err
+	}
+
+	err, timeline := blueskyapi.GetTimeline(ctx, token, "", 50)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []*pendingActivity{}
+
+	// Retweets, grouped by the post that was retweeted
+	retweets := map[string]*pendingActivity{}
+	for _, item := range timeline.Feed {
+		if item.Reason == nil || item.Reason.Type != "app.bsky.feed.defs#reasonRepost" || item.Reason.By.DID == my_did {
+			continue
+		}
+		post := item.Post
+		activity, ok := retweets[post.URI]
+		if !ok {
+			activity = &pendingActivity{
+				action: "retweet",
+				post:   &post,
+			}
+			retweets[post.URI] = activity
+			pending = append(pending, activity)
+		}
+		activity.sources = append(activity.sources, item.Reason.By)
+		if item.Reason.IndexedAt.After(activity.createdAt) {
+			activity.createdAt = item.Reason.IndexedAt
+		}
+	}
+
+	// Likes & follows from our friends. We fetch these in parallel, as it's a request or two per friend.
+	// Likes come from their like records, as the app view only lets us see our own likes.
+	type friendActivity struct {
+		friend  blueskyapi.Author
+		likes   *blueskyapi.RecordList
+		follows *blueskyapi.RecordList
+	}
+	friendActivities := make([]friendActivity, len(follows.Follows))
+
+	var wg sync.WaitGroup
+	for i, friend := range follows.Follows {
+		wg.Add(1)
+		go func(i int, friend blueskyapi.Author) {
+			defer wg.Done()
+			friendActivities[i].friend = friend
+
+			// These are allowed to fail, as a friend's PDS could be down
+			likeRecords, err := blueskyapi.ListRecords(ctx, token, friend.DID, "app.bsky.feed.like", activityItemsPerFriend)
+			if err == nil {
+				friendActivities[i].likes = likeRecords
+			}
+			followRecords, err := blueskyapi.ListRecords(ctx, token, friend.DID, "app.bsky.graph.follow", activityItemsPerFriend)
+			if err == nil {
+				friendActivities[i].follows = followRecords
+			}
+		}(i, friend)
+	}
+	wg.Wait()
+
+	likes := map[string]*pendingActivity{}
+	usersToLookUp := []string{}
+	for _, friendActivity := range friendActivities {
+		if friendActivity.likes != nil {
+			for _, record := range friendActivity.likes.Records {
+				likeRecord := blueskyapi.LikeRecord{}
+				if err := json.Unmarshal(record.Value, &likeRecord); err != nil || likeRecord.Subject.URI == "" {
+					continue
+				}
+				activity, ok := likes[likeRecord.Subject.URI]
+				if !ok {
+					activity = &pendingActivity{action: "favorite"}
+					likes[likeRecord.Subject.URI] = activity
+					pending = append(pending, activity)
+				}
+				activity.sources = append(activity.sources, friendActivity.friend)
+				if likeRecord.CreatedAt.After(activity.createdAt) {
+					activity.createdAt = likeRecord.CreatedAt
+				}
+			}
+		}
+
+		if friendActivity.follows != nil && len(friendActivity.follows.Records) > 0 {
+			activity := &pendingActivity{
+				action:  "follow",
+				sources: []blueskyapi.Author{friendActivity.friend},
+			}
+			for _, record := range friendActivity.follows.Records {
+				followRecord := blueskyapi.FollowRecord{}
+				if err := json.Unmarshal(record.Value, &followRecord); err != nil {
+					continue
+				}
+				activity.users = append(activity.users, followRecord.Subject)
+				usersToLookUp = append(usersToLookUp, followRecord.Subject)
+				if followRecord.CreatedAt.After(activity.createdAt) {
+					activity.createdAt = followRecord.CreatedAt
+				}
+			}
+			if len(activity.users) > 0 {
+				pending = append(pending, activity)
+			}
+		}
+	}
+
+	// Look up the posts that were liked. Ones that have been deleted since get dropped below, as they have no targets.
+	likedURIs := []string{}
+	for uri := range likes {
+		likedURIs = append(likedURIs, uri)
+	}
+	for _, group := range groupUsers(likedURIs, 25) {
+		posts, err := blueskyapi.GetPosts(ctx, token, group)
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range posts {
+			if activity, ok := likes[post.URI]; ok {
+				activity.post = &post
+			}
+		}
+	}
+
+	// Look up everyone who was followed
+	followedUsers := map[string]bridge.TwitterUser{}
+	if len(usersToLookUp) > 0 {
+		for _, group := range groupUsers(usersToLookUp, 25) {
+			users, err := blueskyapi.GetUsersInfo(ctx, token, group)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				followedUsers[user.ID.String()] = *user
+			}
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].createdAt.After(pending[j].createdAt)
+	})
+
+	activities := []bridge.TwitterActivity{}
+	for _, activity := range pending {
+		sources := []bridge.TwitterUser{}
+		for _, source := range activity.sources {
+			sources = append(sources, *blueskyapi.AuthorTTB(source))
+		}
+
+		targets := []interface{}{}
+		if activity.post != nil {
+			targets = append(targets, TranslatePostToTweet(*activity.post, "", "", nil, nil))
+		}
+		for _, did := range activity.users {
+			if user, ok := followedUsers[bridge.BlueSkyToTwitterID(did).String()]; ok {
+				targets = append(targets, user)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		position := strconv.FormatInt(activity.createdAt.UnixMilli(), 10)
+		activities = append(activities, bridge.TwitterActivity{
+			Action:            activity.action,
+			MaxPosition:       position,
+			MinPosition:       position,
+			CreatedAt:         bridge.TwitterTimeConverter(activity.createdAt),
+			Sources:           sources,
+			SourcesSize:       len(sources),
+			Targets:           targets,
+			TargetsSize:       len(targets),
+			TargetObjects:     []interface{}{},
+			TargetObjectsSize: 0,
+		})
+	}
+
+	return activities, nil
+}
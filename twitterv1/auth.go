@@ -1,10 +1,9 @@
 package twitterv1
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"regexp"
-	"strings"
+	"net/url"
 	"time"
 
 	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
@@ -24,90 +23,93 @@ func access_token(c *fiber.Ctx) error {
 	authUsername := c.FormValue("x_auth_username")
 
 	if authMode == "client_auth" {
-		res, err := blueskyapi.Authenticate(authUsername, authPassword)
+		res, err := blueskyLogin(c.UserContext(), authUsername, authPassword)
 		if err != nil {
-			fmt.Println("Error:", err)
-			return c.SendStatus(401)
+			message, code, status := loginError(c.UserContext(), err)
+			return ReturnError(c, message, code, status)
 		}
 
-		// Our bluesky authentication was sucessful! Now we should store the auth info, encryted, in the DB
-		encryptionkey, err := bridge.GenerateKey()
-		if err != nil {
-			fmt.Println("Error:", err)
-			return c.SendStatus(500)
-		}
-
-		access_token_expiry, err := bridge.GetJWTTokenExpirationUnix(res.AccessJwt)
-		if err != nil {
-			fmt.Println("Error:", err)
-			return c.SendStatus(500)
-		}
-		refresh_token_expiry, err := bridge.GetJWTTokenExpirationUnix(res.RefreshJwt)
-		if err != nil {
-			fmt.Println("Error:", err)
-			return c.SendStatus(500)
+		// xAuth has nowhere to put an invite code, so those get redeemed on the invite page first.
+		if err := checkAccess(c.UserContext(), res, ""); err != nil {
+			discardLogin(c, res)
+			message, code, status := accessError(c, err)
+			return ReturnError(c, message, code, status)
 		}
 
-		uuid, err := db_controller.StoreToken(res.DID, res.AccessJwt, res.RefreshJwt, encryptionkey, *access_token_expiry, *refresh_token_expiry)
-
+		session, err := createSession(c.UserContext(), res)
 		if err != nil {
-			fmt.Println("Error:", err)
+			log.ErrorContext(c.UserContext(), "Failed to create session", "error", err)
 			return c.SendStatus(500)
 		}
-		encryptionkey = strings.ReplaceAll(encryptionkey, "+", "-")
-		encryptionkey = strings.ReplaceAll(encryptionkey, "/", "_")
-		encryptionkey = strings.ReplaceAll(encryptionkey, "=", "") // remove padding
 
-		oauth_token := fmt.Sprintf("%s.%s.%s", bridge.Base64URLEncode(res.DID), bridge.Base64URLEncode(*uuid), encryptionkey)
+		return c.SendString(session)
+	}
 
-		return c.SendString(fmt.Sprintf("oauth_token=%s&oauth_token_secret=%s&user_id=%s&screen_name=twitterapi&x_auth_expires=%f", oauth_token, oauth_token, bridge.BlueSkyToTwitterID(res.DID).String(), *access_token_expiry))
+	// Three legged OAuth, where the user has already logged in through oauth/authorize
+	if verifier := oauthParam(c, "oauth_verifier"); verifier != "" {
+		return exchangeRequestToken(c, oauthParam(c, "oauth_token"), verifier)
 	}
+
 	// We have an unknown request. huh. Probably registration, i'll find a way to send an error msg for that later, as registration is out of scope.
 	return c.SendStatus(501)
 }
 
-// GetAuthFromReq is a helper function to get the user DID and access token from the request.
-// Also does some maintenance tasks like refreshing the access token if it has expired.
-func GetAuthFromReq(c *fiber.Ctx) (*string, *string, *string, error) {
-	authHeader := c.Get("Authorization")
-	fmt.Println(authHeader)
-	// Define a regular expression to match the oauth_token
-	re := regexp.MustCompile(`oauth_token="([^"]+)"`)
-	matches := re.FindStringSubmatch(authHeader)
-
-	if len(matches) < 2 {
-		return nil, nil, nil, errors.New("oauth token not found")
+// createSession stores the auth info from a successful bluesky login, encrypted, in the DB.
+// It returns the response to send back from oauth/access_token, which has the oauth token the client will use from now on.
+func createSession(ctx context.Context, res *blueskyapi.AuthResponse) (string, error) {
+	encryptionkey, err := bridge.GenerateKey()
+	if err != nil {
+		return "", err
 	}
 
-	oauthToken := matches[1]
-	oauthTokenSegments := strings.Split(oauthToken, ".")
-
-	// Replace URL-friendly characters with original base64 characters
+	access_token_expiry, err := bridge.GetJWTTokenExpirationUnix(res.AccessJwt)
+	if err != nil {
+		return "", err
+	}
+	refresh_token_expiry, err := bridge.GetJWTTokenExpirationUnix(res.RefreshJwt)
+	if err != nil {
+		return "", err
+	}
 
-	// Get user DID
-	userDID, err := bridge.Base64URLDecode(oauthTokenSegments[0])
+	pds, err := blueskyapi.SessionPDS(ctx, res)
+	if err != nil {
+		return "", err
+	}
 
+	uuid, err := db_controller.StoreToken(res.DID, res.AccessJwt, res.RefreshJwt, encryptionkey, *access_token_expiry, *refresh_token_expiry, pds)
 	if err != nil {
-		return nil, nil, nil, err
+		return "", err
+	}
+	if configData.BackgroundRefresh {
+		if err := storeWrappedEncryptionKey(res.DID, *uuid, encryptionkey); err != nil {
+			return "", err
+		}
 	}
 
-	// Get our token UUID. This is used to look up the token in the database.
-	tokenUUID, err := bridge.Base64URLDecode(oauthTokenSegments[1])
+	oauth_token := (&oauthToken{DID: res.DID, TokenUUID: *uuid, EncryptionKey: encryptionkey}).String()
 
+	return fmt.Sprintf("oauth_token=%s&oauth_token_secret=%s&user_id=%s&screen_name=%s&x_auth_expires=%f", oauth_token, oauth_token, bridge.BlueSkyToTwitterID(res.DID).String(), url.QueryEscape(res.Handle), *access_token_expiry), nil
+}
+
+// GetAuthFromReq is a helper function to get the user DID and access token from the request.
+// Also does some maintenance tasks like refreshing the access token if it has expired.
+func GetAuthFromReq(c *fiber.Ctx) (*string, *string, *string, error) {
+	token, err := oauthTokenFromRequest(c)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-
-	// Get the encryption key for the data.
-	encryptionKey := oauthTokenSegments[2] + "="
-	encryptionKey = strings.ReplaceAll(encryptionKey, "-", "+")
-	encryptionKey = strings.ReplaceAll(encryptionKey, "_", "/")
+	userDID, tokenUUID, encryptionKey := token.DID, token.TokenUUID, token.EncryptionKey
 
 	// Now onto getting the access token from the database.
-	accessJwt, refreshJwt, access_expiry, refresh_expiry, err := db_controller.GetToken(string(userDID), string(tokenUUID), encryptionKey)
+	accessJwt, _, access_expiry, refresh_expiry, pds, err := db_controller.GetToken(userDID, tokenUUID, encryptionKey)
 
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, sessionError(err)
+	}
+
+	// Sessions from before we kept track of PDSes don't have one, and get looked up instead.
+	if *pds != "" {
+		blueskyapi.SetPDS(userDID, *pds)
 	}
 
 	// Check if the access token has expired
@@ -117,51 +119,35 @@ func GetAuthFromReq(c *fiber.Ctx) (*string, *string, *string, error) {
 		// Lets check if our refresh token has expired
 		if time.Unix(int64(*refresh_expiry), 0).Before(time.Now()) {
 			// Our refresh token has expired. We need to re-authenticate.
-			return nil, nil, nil, errors.New("refresh token has expired")
+			return nil, nil, nil, errRefreshTokenExpired
 		}
 
 		// Our refresh token is still valid. Lets refresh our access token.
-		new_auth, err := blueskyapi.RefreshToken(*refreshJwt)
+		newAccessJwt, err := refreshSession(c.UserContext(), userDID, tokenUUID, encryptionKey, accessTokenExpired)
 
 		if err != nil {
 			return nil, nil, nil, err
 		}
 
-		accessJwt = &new_auth.AccessJwt
-
-		access_token_expiry, err := bridge.GetJWTTokenExpirationUnix(new_auth.AccessJwt)
-		if err != nil {
-			return nil, nil, nil, errors.New("failed to get access token expiry")
-		}
-		refresh_token_expiry, err := bridge.GetJWTTokenExpirationUnix(new_auth.RefreshJwt)
-		if err != nil {
-			return nil, nil, nil, errors.New("failed to get refresh token expiry")
-		}
+		accessJwt = &newAccessJwt
+	}
 
-		db_controller.UpdateToken(string(tokenUUID), string(userDID), new_auth.AccessJwt, new_auth.RefreshJwt, encryptionKey, *access_token_expiry, *refresh_token_expiry)
+	if err := db_controller.TouchToken(userDID, tokenUUID); err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to update when the session was last used", "error", err)
 	}
 
-	userDIDStr := string(userDID)
-	return &userDIDStr, &tokenUUID, accessJwt, nil
+	// Keep track of who this request was for, so the rate limiter knows who to count it against.
+	c.Locals("token_uuid", tokenUUID)
+	c.Locals("access_token", *accessJwt)
+
+	return &userDID, &tokenUUID, accessJwt, nil
 }
 
 func GetEncryptionKeyFromRequest(c *fiber.Ctx) (*string, error) {
-	authHeader := c.Get("Authorization")
-	// Define a regular expression to match the oauth_token
-	re := regexp.MustCompile(`oauth_token="([^"]+)"`)
-	matches := re.FindStringSubmatch(authHeader)
-
-	if len(matches) < 2 {
-		return nil, errors.New("oauth token not found")
+	token, err := oauthTokenFromRequest(c)
+	if err != nil {
+		return nil, err
 	}
 
-	oauthToken := matches[1]
-	oauthTokenSegments := strings.Split(oauthToken, ".")
-
-	// Get the encryption key for the data.
-	encryptionKey := oauthTokenSegments[2] + "="
-	encryptionKey = strings.ReplaceAll(encryptionKey, "-", "+")
-	encryptionKey = strings.ReplaceAll(encryptionKey, "_", "/")
-
-	return &encryptionKey, nil
+	return &token.EncryptionKey, nil
 }
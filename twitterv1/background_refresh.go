@@ -0,0 +1,137 @@
+package twitterv1
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Sessions normally only get refreshed when the app makes a request, so one that isn't opened before its refresh token expires is gone.
+// The session's encryption key only lives in the client's token, so to refresh them ourselves, we keep a copy wrapped with the server's key.
+const (
+	backgroundRefreshInterval    = 10 * time.Minute   // How often we look for sessions to refresh
+	backgroundRefreshWindow      = 7 * 24 * time.Hour // How long before the refresh token expires we refresh it
+	backgroundRefreshMaxFailures = 5                  // After this many failures in a row, we give up on a session until the app refreshes it itself
+)
+
+// Counters for /metrics
+var (
+	backgroundRefreshes        atomic.Int64
+	backgroundRefreshFailures  atomic.Int64
+	backgroundRefreshLastRunAt atomic.Int64
+)
+
+// refreshTokenExpiresSoon is what the background worker uses, so sessions get refreshed well before they'd die.
+func refreshTokenExpiresSoon(accessExpiry time.Time, refreshExpiry time.Time) bool {
+	return refreshExpiry.Before(time.Now().Add(backgroundRefreshWindow))
+}
+
+// checkServerKey makes sure the server key is something we can encrypt with, so we find out at startup rather than on the first login.
+func checkServerKey(serverKey string) error {
+	key, err := base64.StdEncoding.DecodeString(serverKey)
+	if err != nil {
+		return fmt.Errorf("server_key isn't valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("server_key must be 32 bytes, not %d", len(key))
+	}
+	return nil
+}
+
+// storeWrappedEncryptionKey keeps a copy of a session's encryption key, encrypted with the server's key.
+func storeWrappedEncryptionKey(did string, tokenUUID string, encryptionKey string) error {
+	wrappedEncryptionKey, err := bridge.Encrypt(encryptionKey, configData.ServerKey)
+	if err != nil {
+		return err
+	}
+	return db_controller.SetWrappedEncryptionKey(did, tokenUUID, wrappedEncryptionKey)
+}
+
+// runBackgroundRefresh refreshes sessions that are about to expire, forever.
+func runBackgroundRefresh() {
+	for {
+		refreshDueSessions()
+		time.Sleep(backgroundRefreshInterval)
+	}
+}
+
+// refreshDueSessions refreshes every session whose refresh token expires soon.
+// This goes through refreshSession like requests do, so it can't race with the app refreshing the same session.
+func refreshDueSessions() {
+	ctx := context.Background()
+	backgroundRefreshLastRunAt.Store(time.Now().Unix())
+
+	sessions, err := db_controller.GetSessionsDueForRefresh(float64(time.Now().Add(backgroundRefreshWindow).Unix()), backgroundRefreshMaxFailures)
+	if err != nil {
+		log.Error("Failed to get sessions due for refresh", "error", err)
+		return
+	}
+
+	for _, session := range sessions {
+		backgroundRefreshes.Add(1)
+
+		encryptionKey, err := bridge.Decrypt(session.WrappedEncryptionKey, configData.ServerKey)
+		if err == nil {
+			_, err = refreshSession(ctx, session.UserDID, session.TokenUUID, encryptionKey, refreshTokenExpiresSoon)
+		}
+
+		if err != nil {
+			backgroundRefreshFailures.Add(1)
+			log.Warn("Background refresh failed", "token_uuid", session.TokenUUID, "failures", session.RefreshFailures+1, "error", err)
+			if session.RefreshFailures+1 >= backgroundRefreshMaxFailures {
+				log.Warn("Giving up on refreshing session in the background", "token_uuid", session.TokenUUID)
+			}
+		}
+
+		if err := db_controller.RecordRefreshResult(session.UserDID, session.TokenUUID, err); err != nil {
+			log.Error("Failed to record background refresh result", "error", err)
+		}
+	}
+}
+
+// serveMetrics serves /metrics on its own address, so it can be kept away from the internet.
+func serveMetrics(address string) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/metrics", BackgroundRefreshMetrics)
+	if err := app.Listen(address); err != nil {
+		log.Error("Failed to serve metrics", "error", err)
+	}
+}
+
+// BackgroundRefreshMetrics reports how background refresh is going, in the Prometheus text format.
+func BackgroundRefreshMetrics(c *fiber.Ctx) error {
+	failingSessions, err := db_controller.CountFailingSessions()
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to count failing sessions", "error", err)
+		return c.SendStatus(500)
+	}
+
+	enabled := 0
+	if configData.BackgroundRefresh {
+		enabled = 1
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4")
+	return c.SendString(fmt.Sprintf(`# HELP background_refresh_enabled Whether sessions are refreshed in the background.
+# TYPE background_refresh_enabled gauge
+background_refresh_enabled %d
+# HELP background_refresh_attempts_total Background session refreshes attempted.
+# TYPE background_refresh_attempts_total counter
+background_refresh_attempts_total %d
+# HELP background_refresh_failures_total Background session refreshes that failed.
+# TYPE background_refresh_failures_total counter
+background_refresh_failures_total %d
+# HELP background_refresh_failing_sessions Sessions whose last background refresh failed.
+# TYPE background_refresh_failing_sessions gauge
+background_refresh_failing_sessions %d
+# HELP background_refresh_last_run_timestamp_seconds When the background refresh last ran.
+# TYPE background_refresh_last_run_timestamp_seconds gauge
+background_refresh_last_run_timestamp_seconds %d
+`, enabled, backgroundRefreshes.Load(), backgroundRefreshFailures.Load(), failingSessions, backgroundRefreshLastRunAt.Load()))
+}
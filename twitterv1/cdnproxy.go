@@ -1,7 +1,6 @@
 package twitterv1
 
 import (
-	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
@@ -10,13 +9,14 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
 	"github.com/gofiber/fiber/v2"
 	"github.com/nfnt/resize"
 )
 
 func CDNDownscaler(c *fiber.Ctx) error {
 	imageURL := c.Query("url")
-	fmt.Println(imageURL)
+	log.DebugContext(c.UserContext(), "Downscaling image", "url", imageURL)
 	if !strings.HasPrefix(imageURL, "https://cdn.bsky.app/img/") { // Later maybe lift these restrictions?
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
@@ -25,30 +25,12 @@ func CDNDownscaler(c *fiber.Ctx) error {
 	heightStr := c.Query("height")
 
 	// So twitter likes to do a stupid thing where it appends :small or :large to the end of tweet images, so we need to strip that, and use that for dimentions
-
-	if strings.HasSuffix(imageURL, ":small") {
-		imageURL = strings.TrimSuffix(imageURL, ":small")
-
-		// TODO: Find what these values actually used to be
-		// They used to be https://web.archive.org/web/20120412055327/https://dev.twitter.com/docs/api/1/get/help/configuration
-		widthStr = "320"
-		heightStr = ""
-	}
-	if strings.HasSuffix(imageURL, ":thumb") {
-		imageURL = strings.TrimSuffix(imageURL, ":thumb")
-
-		// TODO: Find what these values actually used to be
-		widthStr = "150"
-		heightStr = "150"
-
-	}
-	if strings.HasSuffix(imageURL, ":large") {
-		imageURL = strings.TrimSuffix(imageURL, ":large")
-
-		// TODO: Find what these values actually used to be
-		widthStr = ""
-		heightStr = ""
-
+	var mediaSize *bridge.MediaSize
+	if suffixIndex := strings.LastIndex(imageURL, ":"); suffixIndex != -1 {
+		if size, ok := bridge.MediaSizes[imageURL[suffixIndex+1:]]; ok {
+			imageURL = imageURL[:suffixIndex]
+			mediaSize = &size
+		}
 	}
 
 	width, err := strconv.Atoi(widthStr)
@@ -71,7 +53,17 @@ func CDNDownscaler(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to decode image")
 	}
 
-	if width > 0 || height > 0 {
+	if mediaSize != nil {
+		switch mediaSize.Resize {
+		case "crop":
+			img = centerCrop(img, mediaSize.W, mediaSize.H)
+			if img.Bounds().Dx() > mediaSize.W {
+				img = resize.Resize(uint(mediaSize.W), uint(mediaSize.H), img, resize.Lanczos3)
+			}
+		case "fit":
+			img = resize.Thumbnail(uint(mediaSize.W), uint(mediaSize.H), img, resize.Lanczos3)
+		}
+	} else if width > 0 || height > 0 {
 		img = resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
 	}
 
@@ -93,3 +85,29 @@ func CDNDownscaler(c *fiber.Ctx) error {
 
 	return nil
 }
+
+// centerCrop crops the middle out of an image, so that it has the same aspect ratio as width:height.
+// It returns the image as is if it can't be cropped.
+func centerCrop(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	cropWidth, cropHeight := bounds.Dx(), bounds.Dy()
+	if cropWidth*height > cropHeight*width {
+		cropWidth = cropHeight * width / height
+	} else {
+		cropHeight = cropWidth * height / width
+	}
+	if cropWidth == 0 || cropHeight == 0 {
+		return img
+	}
+	cropX := bounds.Min.X + (bounds.Dx()-cropWidth)/2
+	cropY := bounds.Min.Y + (bounds.Dy()-cropHeight)/2
+
+	// Every image type in the standard library supports SubImage
+	subImager, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return img
+	}
+	return subImager.SubImage(image.Rect(cropX, cropY, cropX+cropWidth, cropY+cropHeight))
+}
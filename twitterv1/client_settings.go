@@ -2,17 +2,36 @@ package twitterv1
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
 	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
 )
 
 // Thanks to bag.xml for helping me get what this request returns
 func PushDestinations(c *fiber.Ctx) error {
+	user_did, session_uuid, _, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
 	old_udid := c.Query("old_udid")
 	udid := c.Query("udid")
 	environment := c.Query("environment")
 
+	if udid != "" {
+		if err := db_controller.StorePushDestination(*user_did, *session_uuid, udid, old_udid, environment); err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to save push destination", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to save push destination")
+		}
+	}
+
 	return c.SendString(fmt.Sprintf(`
 	<?xml version="1.0" encoding="UTF-8"?>
 	<push_notifications>
@@ -23,42 +42,244 @@ func PushDestinations(c *fiber.Ctx) error {
 	`, udid, old_udid, environment))
 }
 
-// TODO
-func GetSettings(c *fiber.Ctx) error {
-	settings := bridge.Config{
+// This is the only thing the client sends when the user logs out, so we treat it as the end of the session.
+// Everything we have for this session gets deleted, and we log out of bluesky too.
+func DestroyPushDestination(c *fiber.Ctx) error {
+	user_did, session_uuid, _, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	encryptionKey, err := GetEncryptionKeyFromRequest(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	// Logging out of bluesky is best effort, as we still want to forget the session if it fails.
+	_, refreshJwt, _, _, _, err := db_controller.GetToken(*user_did, *session_uuid, *encryptionKey)
+	if err == nil {
+		if err := blueskyapi.DeleteSession(c.UserContext(), *refreshJwt); err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to log out of bluesky", "error", err)
+		}
+	}
+
+	if err := db_controller.DeleteSession(*user_did, *session_uuid); err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to log out", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to log out")
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Twitter used the time zone names from Rails, which we need to turn into the tz database names to do anything with them.
+// This isn't every Rails time zone, but it covers the ones people are most likely to pick.
+var railsTimeZones = map[string]string{
+	"Hawaii":                      "Pacific/Honolulu",
+	"Alaska":                      "America/Juneau",
+	"Pacific Time (US & Canada)":  "America/Los_Angeles",
+	"Arizona":                     "America/Phoenix",
+	"Mountain Time (US & Canada)": "America/Denver",
+	"Central Time (US & Canada)":  "America/Chicago",
+	"Eastern Time (US & Canada)":  "America/New_York",
+	"Atlantic Time (Canada)":      "America/Halifax",
+	"Newfoundland":                "America/St_Johns",
+	"Mexico City":                 "America/Mexico_City",
+	"Bogota":                      "America/Bogota",
+	"Buenos Aires":                "America/Argentina/Buenos_Aires",
+	"Brasilia":                    "America/Sao_Paulo",
+	"UTC":                         "Etc/UTC",
+	"London":                      "Europe/London",
+	"Dublin":                      "Europe/Dublin",
+	"Lisbon":                      "Europe/Lisbon",
+	"Paris":                       "Europe/Paris",
+	"Madrid":                      "Europe/Madrid",
+	"Amsterdam":                   "Europe/Amsterdam",
+	"Berlin":                      "Europe/Berlin",
+	"Rome":                        "Europe/Rome",
+	"Stockholm":                   "Europe/Stockholm",
+	"Warsaw":                      "Europe/Warsaw",
+	"Athens":                      "Europe/Athens",
+	"Helsinki":                    "Europe/Helsinki",
+	"Istanbul":                    "Europe/Istanbul",
+	"Moscow":                      "Europe/Moscow",
+	"Cairo":                       "Africa/Cairo",
+	"Nairobi":                     "Africa/Nairobi",
+	"Abu Dhabi":                   "Asia/Muscat",
+	"Karachi":                     "Asia/Karachi",
+	"New Delhi":                   "Asia/Kolkata",
+	"Bangkok":                     "Asia/Bangkok",
+	"Beijing":                     "Asia/Shanghai",
+	"Hong Kong":                   "Asia/Hong_Kong",
+	"Singapore":                   "Asia/Singapore",
+	"Seoul":                       "Asia/Seoul",
+	"Tokyo":                       "Asia/Tokyo",
+	"Adelaide":                    "Australia/Adelaide",
+	"Brisbane":                    "Australia/Brisbane",
+	"Sydney":                      "Australia/Sydney",
+	"Auckland":                    "Pacific/Auckland",
+}
+
+// The only trend location we support, as trends aren't location based on bluesky.
+var worldwideTrendLocation = bridge.TrendLocation{
+	Name:  "Worldwide",
+	Woeid: 1,
+	PlaceType: bridge.PlaceType{
+		Name: "Supername",
+		Code: 19,
+	},
+	Country:     "",
+	URL:         "http://where.yahooapis.com/v1/place/1",
+	CountryCode: nil,
+}
+
+// resolveTimeZone takes either a Rails or tz database time zone name, and gets the tz database name for it.
+func resolveTimeZone(name string) (*time.Location, string, error) {
+	tzinfoName := name
+	if railsTimeZone, ok := railsTimeZones[name]; ok {
+		tzinfoName = railsTimeZone
+	}
+	location, err := time.LoadLocation(tzinfoName)
+	if err != nil {
+		return nil, "", err
+	}
+	return location, tzinfoName, nil
+}
+
+// settingsToTwitter turns our stored settings into what twitter would send back
+func settingsToTwitter(settings *db_controller.UserSettings) bridge.Config {
+	utcOffset := 0
+	if location, _, err := resolveTimeZone(settings.TzinfoName); err == nil {
+		_, utcOffset = time.Now().In(location).Zone()
+	}
+
+	formatHour := func(hour *int) *string {
+		if hour == nil {
+			return nil
+		}
+		hourStr := fmt.Sprintf("%d", *hour)
+		return &hourStr
+	}
+
+	return bridge.Config{
 		SleepTime: bridge.SleepTime{
-			EndTime:   nil,
-			Enabled:   true,
-			StartTime: nil,
+			EndTime:   formatHour(settings.SleepEndTime),
+			Enabled:   settings.SleepTimeEnabled,
+			StartTime: formatHour(settings.SleepStartTime),
 		},
-		TrendLocation: []bridge.TrendLocation{
-			{
-				Name:  "Worldwide",
-				Woeid: 1,
-				PlaceType: bridge.PlaceType{
-					Name: "Supername",
-					Code: 19,
-				},
-				Country:     "",
-				URL:         "http://where.yahooapis.com/v1/place/1",
-				CountryCode: nil,
-			},
-		},
-		Language:            "en",
+		TrendLocation:       []bridge.TrendLocation{worldwideTrendLocation},
+		Language:            settings.Language,
 		AlwaysUseHttps:      false,
 		DiscoverableByEmail: true,
 		TimeZone: bridge.TimeZone{
-			Name:       "Pacific Time (US & Canada)",
-			TzinfoName: "America/Los_Angeles",
-			UtcOffset:  -28800,
+			Name:       settings.TimeZoneName,
+			TzinfoName: settings.TzinfoName,
+			UtcOffset:  utcOffset,
 		},
 		GeoEnabled: true,
 	}
-	xml, err := bridge.XMLEncoder(settings, "Config", "settings")
+}
+
+// sendSettings responds with the settings, in whichever format the client asked for.
+func sendSettings(c *fiber.Ctx, settings *db_controller.UserSettings) error {
+	twitterSettings := settingsToTwitter(settings)
+
+	if strings.HasSuffix(c.Path(), ".json") {
+		return c.JSON(twitterSettings)
+	}
+
+	xml, err := bridge.XMLEncoder(twitterSettings, "Config", "settings")
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to encode settings", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to encode settings")
 	}
 	return c.SendString(*xml)
+}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/get/account/settings
+func GetSettings(c *fiber.Ctx) error {
+	user_did, _, _, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	settings, err := db_controller.GetUserSettings(*user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to get settings", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get settings")
+	}
+
+	return sendSettings(c, settings)
+}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/post/account/settings
+func UpdateSettings(c *fiber.Ctx) error {
+	user_did, _, _, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	settings, err := db_controller.GetUserSettings(*user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to get settings", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get settings")
+	}
+
+	if woeid := c.FormValue("trend_location_woeid"); woeid != "" {
+		if woeid != strconv.Itoa(worldwideTrendLocation.Woeid) {
+			return ReturnError(c, "Sorry, that page does not exist", errorCodeNotFound, fiber.StatusNotFound)
+		}
+		settings.TrendLocationWoeid = worldwideTrendLocation.Woeid
+	}
+
+	if enabled := c.FormValue("sleep_time_enabled"); enabled != "" {
+		settings.SleepTimeEnabled = enabled == "true" || enabled == "t" || enabled == "1"
+	}
+
+	parseHour := func(key string) (*int, error) {
+		value := c.FormValue(key)
+		hour, err := strconv.Atoi(value)
+		if err != nil || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("%s must be an hour between 00 and 23", key)
+		}
+		return &hour, nil
+	}
+	if c.FormValue("start_sleep_time") != "" {
+		if settings.SleepStartTime, err = parseHour("start_sleep_time"); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+	}
+	if c.FormValue("end_sleep_time") != "" {
+		if settings.SleepEndTime, err = parseHour("end_sleep_time"); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+	}
+
+	if timeZone := c.FormValue("time_zone"); timeZone != "" {
+		_, tzinfoName, err := resolveTimeZone(timeZone)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid time zone")
+		}
+		settings.TimeZoneName = timeZone
+		settings.TzinfoName = tzinfoName
+	}
+
+	// This ends up in the langs of every post the user makes, so it has to be a real language tag
+	if lang := c.FormValue("lang"); lang != "" {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid language")
+		}
+		settings.Language = tag.String()
+	}
+
+	if err := db_controller.SetUserSettings(*settings); err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to save settings", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to save settings")
+	}
 
+	return sendSettings(c, settings)
 }
@@ -1,16 +1,214 @@
 package twitterv1
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
+	"net/url"
+	"time"
 
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/text/language"
 )
 
-// TODO: Implement this
+// Twitter's limits on search results per page, & how far back you could page through them.
+const (
+	defaultSearchResultsPerPage = 15
+	maxSearchResultsPerPage     = 100
+	maxSearchResults            = 1000
+)
+
+// https://web.archive.org/web/20120604145322/https://dev.twitter.com/docs/api/1/get/search
+// Search results are flatter than tweets elsewhere, with the user's details mixed in.
+type searchResult struct {
+	CreatedAt            string           `json:"created_at"`
+	Entities             *bridge.Entities `json:"entities,omitempty"`
+	FromUser             string           `json:"from_user"`
+	FromUserID           big.Int          `json:"from_user_id"`
+	FromUserIDStr        string           `json:"from_user_id_str"`
+	FromUserName         string           `json:"from_user_name"`
+	Geo                  interface{}      `json:"geo"`
+	ID                   big.Int          `json:"id"`
+	IDStr                string           `json:"id_str"`
+	ISOLanguageCode      string           `json:"iso_language_code"`
+	Metadata             searchMetadata   `json:"metadata"`
+	ProfileImageURL      string           `json:"profile_image_url"`
+	Source               string           `json:"source"`
+	Text                 string           `json:"text"`
+	ToUserID             *big.Int         `json:"to_user_id"`
+	ToUserIDStr          *string          `json:"to_user_id_str"`
+	InReplyToStatusID    *big.Int         `json:"in_reply_to_status_id,omitempty"`
+	InReplyToStatusIDStr *string          `json:"in_reply_to_status_id_str,omitempty"`
+}
+
+type searchMetadata struct {
+	ResultType string `json:"result_type"`
+}
+
+type searchResponse struct {
+	CompletedIn    float64        `json:"completed_in"`
+	MaxID          big.Int        `json:"max_id"`
+	MaxIDStr       string         `json:"max_id_str"`
+	NextPage       string         `json:"next_page,omitempty"`
+	Page           int            `json:"page"`
+	Query          string         `json:"query"`
+	RefreshURL     string         `json:"refresh_url"`
+	Results        []searchResult `json:"results"`
+	ResultsPerPage int            `json:"results_per_page"`
+	SinceID        big.Int        `json:"since_id"`
+	SinceIDStr     string         `json:"since_id_str"`
+}
+
+// https://web.archive.org/web/20120604145322/https://dev.twitter.com/docs/api/1/get/search
+// Results are always the most recent, as bluesky's top results don't come in an order we can page through by ID.
+// Signed in users get results in the language from their settings, unless they ask for another.
 func Search(c *fiber.Ctx) error {
+	start := time.Now()
+
 	q := c.Query("q")
-	fmt.Println("Search query:", q)
-	return c.SendStatus(fiber.StatusNotImplemented)
+	if q == "" {
+		return ReturnError(c, "q parameter is missing", errorCodeMissingParameter, fiber.StatusBadRequest)
+	}
+
+	// Twitter didn't need you to be signed in to search
+	token := ""
+	lang := ""
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+	if err == nil {
+		token = *oauthToken
+		settings, err := db_controller.GetUserSettings(*user_did)
+		if err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to get settings", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to get settings")
+		}
+		lang = settings.Language
+	} else if !errors.Is(err, errOAuthTokenMissing) {
+		return authError(c, err)
+	}
+	if requestedLang := c.Query("lang"); requestedLang != "" {
+		tag, err := language.Parse(requestedLang)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid language")
+		}
+		lang = tag.String()
+	}
+
+	query, err := parseTimelineQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	// Unlike timelines, search left entities out unless you asked for them
+	query.IncludeEntities = parseTwitterBool(c.Query("include_entities"), false)
+	resultsPerPage := c.QueryInt("rpp", defaultSearchResultsPerPage)
+	if resultsPerPage <= 0 {
+		resultsPerPage = defaultSearchResultsPerPage
+	}
+	if resultsPerPage > maxSearchResultsPerPage {
+		resultsPerPage = maxSearchResultsPerPage
+	}
+	page := c.QueryInt("page", 1)
+	if page <= 0 || page*resultsPerPage > maxSearchResults {
+		page = 1
+	}
+
+	// Bluesky doesn't do pages, so we get everything up to the end of the page we want.
+	query.Count = page * resultsPerPage
+	posts := map[string]blueskyapi.Post{}
+	tweets, _, err := fetchTimeline(query, func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		res, err := blueskyapi.SearchPosts(c.UserContext(), token, q, lang, limit, cursor)
+		if err != nil {
+			return nil, err
+		}
+		timeline := &blueskyapi.Timeline{Cursor: res.Cursor}
+		for _, post := range res.Posts {
+			id := bridge.BskyMsgToTwitterID(post.URI, post.Record.CreatedAt, nil)
+			posts[id.String()] = post
+			timeline.Feed = append(timeline.Feed, blueskyapi.Feed{Post: post})
+		}
+		return timeline, nil
+	}, "")
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to search posts", "error", err)
+		return ReturnError(c, "Internal error", errorCodeInternalError, fiber.StatusInternalServerError)
+	}
+	if len(tweets) > (page-1)*resultsPerPage {
+		tweets = tweets[(page-1)*resultsPerPage:]
+	} else {
+		tweets = nil
+	}
+
+	results := []searchResult{}
+	for _, tweet := range tweets {
+		results = append(results, translateTweetToSearchResult(tweet, posts[tweet.IDStr], query.IncludeEntities))
+	}
+
+	response := searchResponse{
+		Page:           page,
+		Query:          url.QueryEscape(q),
+		Results:        results,
+		ResultsPerPage: resultsPerPage,
+		SinceIDStr:     "0",
+	}
+	if query.SinceID != nil {
+		response.SinceID = *query.SinceID
+		response.SinceIDStr = query.SinceID.String()
+	}
+	// Like twitter, the newest result we've shown is where refreshing picks up from, and paging holds on to the newest result of the first page.
+	newestID := big.NewInt(0)
+	if query.MaxID != nil {
+		newestID = query.MaxID
+	} else if len(results) > 0 {
+		newestID = &results[0].ID
+	}
+	response.MaxID = *newestID
+	response.MaxIDStr = newestID.String()
+	response.RefreshURL = fmt.Sprintf("?since_id=%s&q=%s", newestID.String(), url.QueryEscape(q))
+	if len(results) == resultsPerPage && (page+1)*resultsPerPage <= maxSearchResults {
+		response.NextPage = fmt.Sprintf("?page=%d&max_id=%s&q=%s&rpp=%d", page+1, newestID.String(), url.QueryEscape(q), resultsPerPage)
+	}
+	response.CompletedIn = time.Since(start).Seconds()
+
+	// big.Int only encodes as a number through a pointer
+	return c.JSON(&response)
+}
+
+// translateTweetToSearchResult flattens a tweet into how search results look.
+func translateTweetToSearchResult(tweet bridge.Tweet, post blueskyapi.Post, includeEntities bool) searchResult {
+	createdAt := tweet.CreatedAt
+	if t, err := bridge.TwitterTimeParser(tweet.CreatedAt); err == nil {
+		createdAt = t.UTC().Format(time.RFC1123Z)
+	}
+	isoLanguageCode := ""
+	if len(post.Record.Langs) > 0 {
+		isoLanguageCode = post.Record.Langs[0]
+	}
+
+	result := searchResult{
+		CreatedAt:            createdAt,
+		FromUser:             tweet.User.ScreenName,
+		FromUserID:           tweet.User.ID,
+		FromUserIDStr:        tweet.User.ID.String(),
+		FromUserName:         tweet.User.Name,
+		Geo:                  tweet.Geo,
+		ID:                   tweet.ID,
+		IDStr:                tweet.IDStr,
+		ISOLanguageCode:      isoLanguageCode,
+		Metadata:             searchMetadata{ResultType: "recent"},
+		ProfileImageURL:      tweet.User.ProfileImageURL,
+		Source:               tweet.Source,
+		Text:                 tweet.Text,
+		ToUserID:             tweet.InReplyToUserID,
+		ToUserIDStr:          tweet.InReplyToUserIDStr,
+		InReplyToStatusID:    tweet.InReplyToStatusID,
+		InReplyToStatusIDStr: tweet.InReplyToStatusIDStr,
+	}
+	if includeEntities {
+		result.Entities = &tweet.Entities
+	}
+	return result
 }
 
 // https://web.archive.org/web/20120313235613/https://dev.twitter.com/docs/api/1/get/trends/%3Awoeid
@@ -0,0 +1,19 @@
+package twitterv1
+
+import (
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// https://web.archive.org/web/20120412055327/https://dev.twitter.com/docs/api/1/get/help/configuration
+func HelpConfiguration(c *fiber.Ctx) error {
+	return c.JSON(bridge.HelpConfiguration{
+		CharactersReservedPerMedia: 20,
+		MaxMediaPerUpload:          1,       // Bluesky allows 4, but twitter clients only ever send 1.
+		PhotoSizeLimit:             3145728, // Twitter's limit. Bluesky's is lower, so images have to be resized before they get uploaded.
+		PhotoSizes:                 bridge.MediaSizes,
+		ShortURLLength:             20,
+		ShortURLLengthHttps:        21,
+		NonUsernamePaths:           []string{},
+	})
+}
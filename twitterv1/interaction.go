@@ -1,39 +1,58 @@
 package twitterv1
 
 import (
-	"fmt"
 	"math/big"
 	"time"
 
 	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
 	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
 	"github.com/gofiber/fiber/v2"
 )
 
 // https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/post/statuses/update
 func status_update(c *fiber.Ctx) error {
-	_, _, oauthToken, err := GetAuthFromReq(c)
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
 	status := c.FormValue("status")
 	trim_user := c.FormValue("trim_user")
 	in_reply_to_status_id := c.FormValue("in_reply_to_status_ids")
 
-	fmt.Println("Status:", status)
-	fmt.Println("TrimUser:", trim_user)
-	fmt.Println("InReplyToStatusID:", in_reply_to_status_id)
+	// The post itself doesn't get logged, as it could be going somewhere private.
+	log.DebugContext(c.UserContext(), "Posting status", "length", len(status), "trim_user", trim_user, "in_reply_to_status_id", in_reply_to_status_id)
+
+	// Posts are tagged with the language the user picked in their settings
+	settings, err := db_controller.GetUserSettings(*user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to get settings", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get settings")
+	}
+
+	// Remember which app this was posted from, so we can show it as the tweet's source
+	via, viaURL := "", ""
+	if consumer, ok := c.Locals("consumer").(*db_controller.Consumer); ok {
+		via, viaURL = consumer.Name, consumer.URL
+	}
 
-	if err := blueskyapi.UpdateStatus(*oauthToken, status); err != nil {
-		fmt.Println("Error:", err)
+	post, err := blueskyapi.UpdateStatus(c.UserContext(), *oauthToken, *user_did, status, []string{settings.Language}, via, viaURL)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to update status", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to update status")
 	}
 
-	// TODO: Implement this
+	// TODO: Implement replies
+
+	err, thread := blueskyapi.GetPost(c.UserContext(), *oauthToken, post.URI, 0, 1)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch new status", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch new status")
+	}
 
-	return c.SendString("Not implemented")
+	return c.JSON(TranslatePostToTweet(thread.Thread.Post, "", "", nil, nil))
 }
 
 // https://web.archive.org/web/20120407091252/https://dev.twitter.com/docs/api/1/post/statuses/retweet/%3Aid
@@ -42,7 +61,7 @@ func retweet(c *fiber.Ctx) error {
 	user_did, _, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
 	idBigInt, ok := new(big.Int).SetString(postId, 10)
@@ -51,10 +70,10 @@ func retweet(c *fiber.Ctx) error {
 	}
 	postId, _, _ = bridge.TwitterMsgIdToBluesky(idBigInt)
 
-	err, originalPost, retweetPostURI := blueskyapi.ReTweet(*oauthToken, postId, *user_did)
+	err, originalPost, retweetPostURI := blueskyapi.ReTweet(c.UserContext(), *oauthToken, postId, *user_did)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to update status", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to update status")
 	}
 
@@ -75,7 +94,7 @@ func favourite(c *fiber.Ctx) error {
 	user_did, _, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
 	idBigInt, ok := new(big.Int).SetString(postId, 10)
@@ -83,12 +102,12 @@ func favourite(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid ID format")
 	}
 	postId, _, _ = bridge.TwitterMsgIdToBluesky(idBigInt)
-	fmt.Println("Post ID:", postId)
+	log.DebugContext(c.UserContext(), "Liking post", "uri", postId)
 
-	err, post := blueskyapi.LikePost(*oauthToken, postId, *user_did)
+	err, post := blueskyapi.LikePost(c.UserContext(), *oauthToken, postId, *user_did)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to like post", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to like post")
 	}
 
@@ -103,7 +122,7 @@ func Unfavourite(c *fiber.Ctx) error { // yes i am canadian
 	user_did, _, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
 	idBigInt, ok := new(big.Int).SetString(postId, 10)
@@ -112,10 +131,10 @@ func Unfavourite(c *fiber.Ctx) error { // yes i am canadian
 	}
 	postId, _, _ = bridge.TwitterMsgIdToBluesky(idBigInt)
 
-	err, post := blueskyapi.UnlikePost(*oauthToken, postId, *user_did)
+	err, post := blueskyapi.UnlikePost(c.UserContext(), *oauthToken, postId, *user_did)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to unlike post", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to unlike post")
 	}
 
@@ -0,0 +1,68 @@
+package twitterv1
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Twitter clients only have a password box, so accounts with email 2FA put the code after their password, eg. "hunter2 ABCDE-FGHIJ"
+const authFactorTokenSeparator = " "
+
+// What bluesky's email sign in codes look like
+var authFactorTokenRegex = regexp.MustCompile(`^[A-Za-z0-9]{5}-[A-Za-z0-9]{5}$`)
+
+// normalizeIdentifier turns whatever the user typed as their username into something bluesky will accept.
+// Emails and DIDs are left alone, and usernames without a domain get the instance's default one.
+func normalizeIdentifier(identifier string) string {
+	identifier = strings.TrimSpace(identifier)
+	if strings.Contains(identifier, "@") && !strings.HasPrefix(identifier, "@") {
+		return identifier // An email
+	}
+	identifier = strings.TrimPrefix(identifier, "@")
+	if strings.HasPrefix(identifier, "did:") || strings.Contains(identifier, ".") {
+		return identifier
+	}
+	return identifier + "." + configData.DefaultHandleDomain
+}
+
+// blueskyLogin logs in to bluesky, with support for email sign in codes put after the password.
+func blueskyLogin(ctx context.Context, identifier string, password string) (*blueskyapi.AuthResponse, error) {
+	identifier = normalizeIdentifier(identifier)
+
+	// Passwords can have spaces in them, so if it looks like there's a code but that doesn't work, we try the whole thing as the password.
+	if i := strings.LastIndex(password, authFactorTokenSeparator); i != -1 {
+		authFactorToken := strings.ToUpper(password[i+len(authFactorTokenSeparator):])
+		if authFactorTokenRegex.MatchString(authFactorToken) {
+			res, err := blueskyapi.Authenticate(ctx, identifier, password[:i], authFactorToken)
+			if err != blueskyapi.ErrInvalidCredentials {
+				return res, err
+			}
+		}
+	}
+
+	return blueskyapi.Authenticate(ctx, identifier, password, "")
+}
+
+// loginError works out what to tell the client when logging in fails.
+// Returns the message, the twitter error code, and the HTTP status.
+func loginError(ctx context.Context, err error) (string, int, int) {
+	switch err {
+	case blueskyapi.ErrInvalidCredentials:
+		return "Could not authenticate you", errorCodeCouldNotAuthenticate, fiber.StatusUnauthorized
+	case blueskyapi.ErrAuthFactorTokenRequired:
+		return "User must verify login. Check your email for a sign in code, and enter it after your password, separated by a space.", errorCodeLoginVerification, fiber.StatusUnauthorized
+	case blueskyapi.ErrInvalidAuthFactorToken:
+		return "User must verify login. The sign in code was incorrect or has expired.", errorCodeLoginVerification, fiber.StatusUnauthorized
+	case blueskyapi.ErrAccountTakedown:
+		return "Your account is suspended and is not permitted to access this feature", errorCodeAccountSuspended, fiber.StatusForbidden
+	case blueskyapi.ErrRateLimited:
+		return "Rate limit exceeded", errorCodeRateLimitExceeded, fiber.StatusTooManyRequests
+	default:
+		log.ErrorContext(ctx, "Failed to log in", "error", err)
+		return "Internal error", errorCodeInternalError, fiber.StatusInternalServerError
+	}
+}
@@ -0,0 +1,291 @@
+package twitterv1
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// How long a client has to get the user logged in, and trade the request token for an access token.
+const requestTokenTTL = 10 * time.Minute
+
+// The page users log in on during three legged OAuth. It doubles as the page that shows the PIN for clients that can't take a callback.
+var authorizePageTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Authorize app</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; background: #C0DEED; margin: 0; padding: 20px; }
+.box { background: #fff; max-width: 400px; margin: 40px auto; padding: 20px; border-radius: 6px; }
+input[type=text], input[type=password] { width: 100%; box-sizing: border-box; padding: 8px; margin: 4px 0 12px; }
+.error { color: #c00; }
+.pin { font-size: 32px; letter-spacing: 4px; text-align: center; }
+</style>
+</head>
+<body>
+<div class="box">
+{{if .PIN}}
+<h2>You've authorized the app</h2>
+<p>Enter this PIN in the app to finish logging in.</p>
+<p class="pin"><code>{{.PIN}}</code></p>
+{{else if .InvalidToken}}
+<h2>Something went wrong</h2>
+<p class="error">This login link is invalid or has expired. Go back to the app and try again.</p>
+{{else}}
+<h2>Authorize an app to use your Bluesky account</h2>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+<input type="hidden" name="oauth_token" value="{{.Token}}">
+<label>Handle or email<input type="text" name="handle" value="{{.Handle}}" placeholder="you.bsky.social" autocapitalize="off" autocorrect="off"></label>
+<label>Password<input type="password" name="password"></label>
+{{if .InviteOnly}}<label>Invite code <small>(only needed the first time)</small><input type="text" name="invite_code" value="{{.InviteCode}}" autocapitalize="off" autocorrect="off"></label>{{end}}
+<p><small>We recommend using an app password from Settings &rarr; Privacy and security &rarr; App passwords. If you use your main password and have email 2FA on, put the code we email you after your password, separated by a space.</small></p>
+<input type="submit" value="Authorize app">
+</form>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+type authorizePage struct {
+	Token        string
+	Handle       string
+	Error        string
+	PIN          string
+	InvalidToken bool
+	InviteOnly   bool
+	InviteCode   string
+}
+
+func renderAuthorizePage(c *fiber.Ctx, status int, page authorizePage) error {
+	var sb strings.Builder
+	if err := authorizePageTemplate.Execute(&sb, page); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(status).SendString(sb.String())
+}
+
+// oauthParam gets an OAuth parameter, which can be in the Authorization header, the form, or the query string.
+func oauthParam(c *fiber.Ctx, key string) string {
+	if value, ok := parseOAuthHeader(c.Get("Authorization"))[key]; ok {
+		return value
+	}
+	return c.FormValue(key)
+}
+
+func generateRequestToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// generateVerifier makes a 7 digit PIN, short enough for someone to type into an app.
+func generateVerifier() (string, error) {
+	pin, err := rand.Int(rand.Reader, big.NewInt(10000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%07d", pin.Int64()), nil
+}
+
+// requestTokenSessionKey is the key the login waiting on a request token is encrypted with.
+// We never store the verifier, so the DB alone isn't enough to get the login back out.
+func requestTokenSessionKey(token string, verifier string) string {
+	key := sha256.Sum256([]byte(token + ":" + verifier))
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// allowedCallback checks where we can send someone after they log in, along with the verifier for their login.
+// It has to be a web page, and registered apps can only send people back to their own site.
+// consumer is nil for apps that aren't registered, as we have nothing to check their callback against.
+func allowedCallback(callback string, consumer *db_controller.Consumer) bool {
+	if callback == "oob" {
+		return true
+	}
+	callbackURL, err := url.Parse(callback)
+	if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") || callbackURL.Host == "" || callbackURL.User != nil {
+		return false
+	}
+	if consumer == nil {
+		return true
+	}
+
+	consumerURL, err := url.Parse(consumer.URL)
+	if err != nil || consumerURL.Host == "" {
+		return false
+	}
+	return callbackURL.Scheme == consumerURL.Scheme && strings.EqualFold(callbackURL.Host, consumerURL.Host)
+}
+
+// https://web.archive.org/web/20120708225149/https://dev.twitter.com/docs/api/1/post/oauth/request_token
+func RequestToken(c *fiber.Ctx) error {
+	callback := oauthParam(c, "oauth_callback")
+	if callback == "" {
+		callback = "oob"
+	}
+
+	consumer, _ := c.Locals("consumer").(*db_controller.Consumer)
+	if !allowedCallback(callback, consumer) {
+		return ReturnError(c, "Callback URL not approved for this client application", errorCodeAccessDenied, fiber.StatusForbidden)
+	}
+
+	token, err := generateRequestToken()
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to generate request token", "error", err)
+		return c.SendStatus(500)
+	}
+
+	if err := db_controller.StoreRequestToken(token, callback, time.Now().Add(requestTokenTTL)); err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to store request token", "error", err)
+		return c.SendStatus(500)
+	}
+
+	// Like our access tokens, the secret is just the token again.
+	return c.SendString(fmt.Sprintf("oauth_token=%s&oauth_token_secret=%s&oauth_callback_confirmed=true", token, token))
+}
+
+// https://web.archive.org/web/20120708225149/https://dev.twitter.com/docs/api/1/get/oauth/authorize
+// This is also used for oauth/authenticate, as we can't tell if the user has already allowed the app.
+func AuthorizePage(c *fiber.Ctx) error {
+	token := c.Query("oauth_token")
+	if requestToken, err := db_controller.GetRequestToken(token); err != nil || requestToken.EncryptedSession != "" {
+		return renderAuthorizePage(c, fiber.StatusBadRequest, authorizePage{InvalidToken: true})
+	}
+
+	return renderAuthorizePage(c, fiber.StatusOK, authorizePage{Token: token, InviteOnly: configData.AccessPolicy == accessPolicyInvite})
+}
+
+// Authorize handles the login form from AuthorizePage.
+// We log in to bluesky straight away, so the user finds out here if their password is wrong, rather than in the app.
+func Authorize(c *fiber.Ctx) error {
+	token := c.FormValue("oauth_token")
+	handle := strings.TrimSpace(c.FormValue("handle"))
+	password := c.FormValue("password")
+	inviteCode := strings.TrimSpace(c.FormValue("invite_code"))
+	inviteOnly := configData.AccessPolicy == accessPolicyInvite
+
+	// Someone has already logged in with this request token. Letting someone else log in would swap out their session.
+	// Registered apps had their callback checked when the request token was made. This catches tokens made before callbacks were checked.
+	requestToken, err := db_controller.GetRequestToken(token)
+	if err != nil || requestToken.EncryptedSession != "" || !allowedCallback(requestToken.Callback, nil) {
+		return renderAuthorizePage(c, fiber.StatusBadRequest, authorizePage{InvalidToken: true})
+	}
+
+	if handle == "" || password == "" {
+		return renderAuthorizePage(c, fiber.StatusBadRequest, authorizePage{Token: token, Handle: handle, Error: "Enter your handle and password.", InviteOnly: inviteOnly, InviteCode: inviteCode})
+	}
+
+	res, err := blueskyLogin(c.UserContext(), handle, password)
+	if err != nil {
+		message, _, status := loginError(c.UserContext(), err)
+		if err == blueskyapi.ErrInvalidCredentials {
+			message = "Your handle or password is incorrect."
+		}
+		return renderAuthorizePage(c, status, authorizePage{Token: token, Handle: handle, Error: message, InviteOnly: inviteOnly, InviteCode: inviteCode})
+	}
+
+	if err := checkAccess(c.UserContext(), res, inviteCode); err != nil {
+		discardLogin(c, res)
+		message, _, status := accessError(c, err)
+		if err == errInviteRequired {
+			message = "This server is invite only. Enter your invite code."
+		}
+		return renderAuthorizePage(c, status, authorizePage{Token: token, Handle: handle, Error: message, InviteOnly: inviteOnly, InviteCode: inviteCode})
+	}
+
+	verifier, err := generateVerifier()
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to generate verifier", "error", err)
+		return c.SendStatus(500)
+	}
+
+	// The session itself only gets made when the client trades in the request token, so abandoned logins don't leave sessions behind.
+	login, err := json.Marshal(res)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to encode login", "error", err)
+		return c.SendStatus(500)
+	}
+	encryptedLogin, err := bridge.Encrypt(string(login), requestTokenSessionKey(token, verifier))
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to encrypt login", "error", err)
+		return c.SendStatus(500)
+	}
+	if err := db_controller.AuthorizeRequestToken(token, encryptedLogin); err != nil {
+		discardLogin(c, res)
+		return renderAuthorizePage(c, fiber.StatusBadRequest, authorizePage{InvalidToken: true})
+	}
+
+	if requestToken.Callback == "oob" {
+		return renderAuthorizePage(c, fiber.StatusOK, authorizePage{PIN: verifier})
+	}
+
+	callbackURL, err := url.Parse(requestToken.Callback)
+	if err != nil {
+		return renderAuthorizePage(c, fiber.StatusBadRequest, authorizePage{InvalidToken: true})
+	}
+	query := callbackURL.Query()
+	query.Set("oauth_token", token)
+	query.Set("oauth_verifier", verifier)
+	callbackURL.RawQuery = query.Encode()
+
+	return c.Redirect(callbackURL.String())
+}
+
+// exchangeRequestToken trades an authorized request token & its verifier for an access token.
+// A request token only gets one try, so the verifier can't be guessed.
+func exchangeRequestToken(c *fiber.Ctx, token string, verifier string) error {
+	// The token is gone once we've claimed it, whether the verifier is right or not
+	requestToken, err := db_controller.ClaimRequestToken(token)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.SendStatus(401)
+	} else if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to claim request token", "error", err)
+		return c.SendStatus(500)
+	}
+
+	login, err := bridge.Decrypt(requestToken.EncryptedSession, requestTokenSessionKey(token, verifier))
+	if err != nil {
+		return c.SendStatus(401)
+	}
+
+	res := blueskyapi.AuthResponse{}
+	if err := json.Unmarshal([]byte(login), &res); err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to decode login", "error", err)
+		return c.SendStatus(500)
+	}
+
+	// The policy could have changed since they logged in
+	if err := checkAccess(c.UserContext(), &res, ""); err != nil {
+		discardLogin(c, &res)
+		message, code, status := accessError(c, err)
+		return ReturnError(c, message, code, status)
+	}
+
+	session, err := createSession(c.UserContext(), &res)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to create session", "error", err)
+		return c.SendStatus(500)
+	}
+
+	return c.SendString(session)
+}
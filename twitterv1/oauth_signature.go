@@ -0,0 +1,218 @@
+package twitterv1
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// How far a request's timestamp can be from our clock. Nonces only need to be remembered for this long,
+// as anything older gets rejected because of its timestamp anyway.
+const oauthTimestampWindow = 5 * time.Minute
+
+var oauthHeaderParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+var (
+	oauthNonces      = map[string]time.Time{}
+	oauthNoncesMutex sync.Mutex
+)
+
+var (
+	errOAuthUnknownConsumer = errors.New("unknown consumer")
+	errOAuthTimestamp       = errors.New("timestamp out of bounds")
+	errOAuthNonceUsed       = errors.New("nonce has already been used")
+	errOAuthSignature       = errors.New("invalid signature")
+)
+
+// parseOAuthHeader gets the parameters out of an "Authorization: OAuth ..." header.
+func parseOAuthHeader(header string) map[string]string {
+	params := map[string]string{}
+	if !strings.HasPrefix(header, "OAuth ") {
+		return params
+	}
+	for _, match := range oauthHeaderParamRegex.FindAllStringSubmatch(header, -1) {
+		value, err := url.PathUnescape(match[2])
+		if err != nil {
+			value = match[2]
+		}
+		params[match[1]] = value
+	}
+	return params
+}
+
+// oauthPercentEncode encodes a string the way RFC 5849 wants, where only unreserved characters are left alone.
+func oauthPercentEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// oauthSignatureBaseString builds the string that gets signed, from RFC 5849 section 3.4.1.
+// The parameters are the query string, the body if it's a form, and the OAuth header (except the signature itself).
+func oauthSignatureBaseString(c *fiber.Ctx, oauthParams map[string]string) string {
+	type param struct{ key, value string }
+	params := []param{}
+
+	c.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+		params = append(params, param{oauthPercentEncode(string(key)), oauthPercentEncode(string(value))})
+	})
+	if strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEApplicationForm) {
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			params = append(params, param{oauthPercentEncode(string(key)), oauthPercentEncode(string(value))})
+		})
+	}
+	for key, value := range oauthParams {
+		if key == "oauth_signature" || key == "realm" {
+			continue
+		}
+		params = append(params, param{oauthPercentEncode(key), oauthPercentEncode(value)})
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key == params[j].key {
+			return params[i].value < params[j].value
+		}
+		return params[i].key < params[j].key
+	})
+
+	normalized := make([]string, len(params))
+	for i, p := range params {
+		normalized[i] = p.key + "=" + p.value
+	}
+
+	return strings.ToUpper(c.Method()) + "&" + oauthPercentEncode(oauthBaseURL(c)) + "&" + oauthPercentEncode(strings.Join(normalized, "&"))
+}
+
+// oauthBaseURL gets the URL the client signed, which is lowercase, and leaves out the port if it's the default one.
+// Behind a proxy, the request we get isn't the one the client made, so this comes from the configured address if there is one.
+func oauthBaseURL(c *fiber.Ctx) string {
+	address, err := url.Parse(serverURL(c))
+	if err != nil || address.Host == "" {
+		address = &url.URL{Scheme: c.Protocol(), Host: string(c.Request().Host())}
+	}
+
+	scheme := strings.ToLower(address.Scheme)
+	host := strings.ToLower(address.Host)
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	return scheme + "://" + host + strings.TrimSuffix(address.Path, "/") + c.Path()
+}
+
+// useOAuthNonce remembers a nonce, failing if it has been seen before.
+// Our tokens have the session's encryption key in them, so we only keep a hash of the token.
+func useOAuthNonce(consumerKey string, token string, nonce string) error {
+	tokenHash := sha256.Sum256([]byte(token))
+	key := consumerKey + "&" + hex.EncodeToString(tokenHash[:]) + "&" + nonce
+
+	oauthNoncesMutex.Lock()
+	defer oauthNoncesMutex.Unlock()
+
+	if _, ok := oauthNonces[key]; ok {
+		return errOAuthNonceUsed
+	}
+	oauthNonces[key] = time.Now()
+	return nil
+}
+
+// forgetOldOAuthNonces forgets nonces that are too old to matter, forever.
+func forgetOldOAuthNonces() {
+	for range time.Tick(oauthTimestampWindow) {
+		oauthNoncesMutex.Lock()
+		for key, seen := range oauthNonces {
+			if time.Since(seen) > 2*oauthTimestampWindow {
+				delete(oauthNonces, key)
+			}
+		}
+		oauthNoncesMutex.Unlock()
+	}
+}
+
+// verifyOAuthRequest checks a request's OAuth signature, timestamp and nonce.
+// It returns the consumer that made the request, or nil if they aren't registered.
+// Our token secrets are the tokens themselves, so we don't need to look anything up to get them.
+func verifyOAuthRequest(c *fiber.Ctx, oauthParams map[string]string) (*db_controller.Consumer, error) {
+	consumer, err := db_controller.GetConsumer(oauthParams["oauth_consumer_key"])
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if configData.UnknownConsumers != "allow" {
+			return nil, errOAuthUnknownConsumer
+		}
+		consumer = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if timestampStr, ok := oauthParams["oauth_timestamp"]; ok || consumer != nil {
+		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			return nil, errOAuthTimestamp
+		}
+		if difference := time.Since(time.Unix(timestamp, 0)); difference > oauthTimestampWindow || difference < -oauthTimestampWindow {
+			return nil, errOAuthTimestamp
+		}
+	}
+
+	// We can't check the signature without the consumer secret, so unknown consumers skip this.
+	if consumer != nil {
+		if oauthParams["oauth_signature_method"] != "HMAC-SHA1" {
+			return nil, errOAuthSignature
+		}
+		signature, err := base64.StdEncoding.DecodeString(oauthParams["oauth_signature"])
+		if err != nil {
+			return nil, errOAuthSignature
+		}
+
+		mac := hmac.New(sha1.New, []byte(oauthPercentEncode(consumer.Secret)+"&"+oauthPercentEncode(oauthParams["oauth_token"])))
+		mac.Write([]byte(oauthSignatureBaseString(c, oauthParams)))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errOAuthSignature
+		}
+	}
+
+	// The nonce only gets used up once we know the request is real, so forged requests can't burn through someone else's.
+	if nonce, ok := oauthParams["oauth_nonce"]; ok || consumer != nil {
+		if err := useOAuthNonce(oauthParams["oauth_consumer_key"], oauthParams["oauth_token"], nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	return consumer, nil
+}
+
+// OAuthSignatureMiddleware checks every request that has an OAuth header, before it gets to the handler.
+// Registered consumers are kept in c.Locals("consumer"), so handlers know which app they're talking to.
+// https://web.archive.org/web/20120708225149/https://dev.twitter.com/docs/auth/authorizing-request
+func OAuthSignatureMiddleware(c *fiber.Ctx) error {
+	oauthParams := parseOAuthHeader(c.Get("Authorization"))
+	if len(oauthParams) == 0 {
+		return c.Next()
+	}
+
+	consumer, err := verifyOAuthRequest(c, oauthParams)
+	switch err {
+	case nil:
+		if consumer != nil {
+			c.Locals("consumer", consumer)
+		}
+		return c.Next()
+	case errOAuthTimestamp:
+		return ReturnError(c, "Timestamp out of bounds", errorCodeTimestampOutOfBounds, fiber.StatusUnauthorized)
+	case errOAuthUnknownConsumer, errOAuthNonceUsed, errOAuthSignature:
+		return ReturnError(c, "Could not authenticate you", errorCodeCouldNotAuthenticate, fiber.StatusUnauthorized)
+	default:
+		log.ErrorContext(c.UserContext(), "Failed to verify OAuth signature", "error", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+}
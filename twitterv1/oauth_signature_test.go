@@ -0,0 +1,105 @@
+package twitterv1
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Preloading/MastodonTwitterAPI/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// captureFromRequest runs a request through fiber, and returns what get makes of it.
+func captureFromRequest(t *testing.T, method string, target string, contentType string, body string, get func(c *fiber.Ctx) string) string {
+	t.Helper()
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		return c.SendString(get(c))
+	})
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestOAuthBaseURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		target string
+		want   string
+	}{
+		// https://www.rfc-editor.org/rfc/rfc5849#section-3.4.1.2
+		{"default port", "", "http://EXAMPLE.COM:80/r%20v/X?id=123", "http://example.com/r%20v/X"},
+		{"other port", "https://www.example.net:8080", "http://10.0.0.5:3000/?q=1", "https://www.example.net:8080/"},
+		{"request address", "", "http://192.168.1.20:3000/1/statuses/home_timeline.json", "http://192.168.1.20:3000/1/statuses/home_timeline.json"},
+		{"behind a proxy", "https://Bridge.Example.com:443/twitter/", "http://127.0.0.1:3000/1/statuses/update.json", "https://bridge.example.com/twitter/1/statuses/update.json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configData = &config.Config{URL: test.url}
+			got := captureFromRequest(t, fiber.MethodGet, test.target, "", "", oauthBaseURL)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOAuthSignatureBaseString(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		header      string
+		want        string
+	}{
+		{
+			// https://www.rfc-editor.org/rfc/rfc5849#section-3.4.1.1
+			name:        "rfc 5849",
+			method:      fiber.MethodPost,
+			target:      "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b",
+			contentType: fiber.MIMEApplicationForm,
+			body:        "c2&a3=2+q",
+			header:      `OAuth realm="Example", oauth_consumer_key="9djdj82h48djs9d2", oauth_token="kkk9d7dh3k39sjv7", oauth_signature_method="HMAC-SHA1", oauth_timestamp="137131201", oauth_nonce="7d8f3e4a", oauth_signature="bYT5CMsGcbgUdFHObYMEfcx6bsw%3D"`,
+			want:        "POST&http%3A%2F%2Fexample.com%2Frequest&a2%3Dr%2520b%26a3%3D2%2520q%26a3%3Da%26b5%3D%253D%25253D%26c%2540%3D%26c2%3D%26oauth_consumer_key%3D9djdj82h48djs9d2%26oauth_nonce%3D7d8f3e4a%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk9d7dh3k39sjv7",
+		},
+		{
+			// Only form bodies are signed
+			name:        "json body",
+			method:      fiber.MethodPost,
+			target:      "http://example.com/1/statuses/update.json?b=2",
+			contentType: fiber.MIMEApplicationJSON,
+			body:        `{"a":"1"}`,
+			header:      `OAuth oauth_consumer_key="key", oauth_nonce="nonce"`,
+			want:        "POST&http%3A%2F%2Fexample.com%2F1%2Fstatuses%2Fupdate.json&b%3D2%26oauth_consumer_key%3Dkey%26oauth_nonce%3Dnonce",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configData = &config.Config{}
+			got := captureFromRequest(t, test.method, test.target, test.contentType, test.body, func(c *fiber.Ctx) string {
+				return oauthSignatureBaseString(c, parseOAuthHeader(test.header))
+			})
+			if got != test.want {
+				t.Errorf("got  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package twitterv1
+
+import (
+	"fmt"
+	"html"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Twitter kept embeds between these widths, no matter what maxwidth was.
+const (
+	oembedMinWidth = 250
+	oembedMaxWidth = 550
+)
+
+// oembedPostURI works out which post an oEmbed request is for.
+// The url can either be a twitter style status link with one of our IDs, or a link to the post on bsky.app.
+func oembedPostURI(id string, link string) (string, bool) {
+	if id == "" && link != "" {
+		parsedURL, err := url.Parse(link)
+		if err != nil {
+			return "", false
+		}
+		segments := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+
+		// https://bsky.app/profile/<handle or did>/post/<rkey>
+		if len(segments) == 4 && segments[0] == "profile" && segments[2] == "post" {
+			return "at://" + segments[1] + "/app.bsky.feed.post/" + segments[3], true
+		}
+		id = segments[len(segments)-1]
+	}
+
+	idBigInt, ok := new(big.Int).SetString(id, 10)
+	if !ok {
+		return "", false
+	}
+	uri, _, _ := bridge.TwitterMsgIdToBluesky(idBigInt)
+	return uri, true
+}
+
+// bskyPostPermalink gets the link to a post on bsky.app
+func bskyPostPermalink(post blueskyapi.Post) string {
+	rkey := post.URI[strings.LastIndex(post.URI, "/")+1:]
+	return "https://bsky.app/profile/" + post.Author.Handle + "/post/" + rkey
+}
+
+// isWebURL checks that a URL is an absolute http or https URL, and not something like javascript: that would run if clicked.
+func isWebURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	return (scheme == "http" || scheme == "https") && parsed.Host != ""
+}
+
+// renderFacetsHTML turns a post's text into HTML, with mentions, links and hashtags turned into links.
+// Facets are indexed by bytes, so we have to work with the text as bytes too.
+func renderFacetsHTML(text string, facets []blueskyapi.Facet) string {
+	facets = append([]blueskyapi.Facet{}, facets...)
+	sort.Slice(facets, func(i, j int) bool {
+		return facets[i].Index.ByteStart < facets[j].Index.ByteStart
+	})
+
+	var sb strings.Builder
+	position := 0
+	for _, facet := range facets {
+		start, end := facet.Index.ByteStart, facet.Index.ByteEnd
+		// Skip anything that overlaps what we've already written, or that doesn't fit in the text.
+		if start < position || end > len(text) || start >= end || len(facet.Features) == 0 {
+			continue
+		}
+
+		href := ""
+		switch facet.Features[0].Type {
+		case "app.bsky.richtext.facet#mention":
+			href = "https://bsky.app/profile/" + facet.Features[0].Did
+		case "app.bsky.richtext.facet#link":
+			// Anyone can put anything in a facet, and this HTML ends up on other people's sites, so we only link to websites.
+			if !isWebURL(facet.Features[0].URI) {
+				continue
+			}
+			href = facet.Features[0].URI
+		case "app.bsky.richtext.facet#tag":
+			href = "https://bsky.app/hashtag/" + url.PathEscape(facet.Features[0].Tag)
+		default:
+			continue
+		}
+
+		sb.WriteString(html.EscapeString(text[position:start]))
+		sb.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(text[start:end]) + `</a>`)
+		position = end
+	}
+	sb.WriteString(html.EscapeString(text[position:]))
+
+	return strings.ReplaceAll(sb.String(), "\n", "<br>")
+}
+
+// https://web.archive.org/web/20121014095216/https://dev.twitter.com/docs/api/1/get/statuses/oembed
+// This doesn't need a login, so that tools outside of a twitter client can use it.
+func StatusOEmbed(c *fiber.Ctx) error {
+	uri, ok := oembedPostURI(c.Query("id"), c.Query("url"))
+	if !ok {
+		return ReturnError(c, "Missing or invalid id or url parameter", errorCodeMissingParameter, fiber.StatusBadRequest)
+	}
+
+	// Use the user's token if they have one, but don't require it.
+	token := ""
+	if c.Get("Authorization") != "" {
+		if _, _, oauthToken, err := GetAuthFromReq(c); err == nil {
+			token = *oauthToken
+		}
+	}
+
+	err, thread := blueskyapi.GetPost(c.UserContext(), token, uri, 0, 0)
+	if err != nil || thread.Thread.Post.URI == "" {
+		return ReturnError(c, "Sorry, that page does not exist", errorCodeNotFound, fiber.StatusNotFound)
+	}
+	post := thread.Thread.Post
+
+	width := c.QueryInt("maxwidth", oembedMaxWidth)
+	if width < oembedMinWidth {
+		width = oembedMinWidth
+	}
+	if width > oembedMaxWidth {
+		width = oembedMaxWidth
+	}
+
+	class := "twitter-tweet"
+	switch align := c.Query("align"); align {
+	case "left", "right", "center":
+		class += " tw-align-" + align
+	}
+
+	name := post.Author.DisplayName
+	if name == "" {
+		name = post.Author.Handle
+	}
+	permalink := bskyPostPermalink(post)
+	authorURL := "https://bsky.app/profile/" + post.Author.Handle
+	createdAt := post.Record.CreatedAt.UTC()
+
+	embedHTML := fmt.Sprintf(`<blockquote class="%s" width="%d"><p>%s</p>&mdash; %s (@%s) <a href="%s" data-datetime="%s">%s</a></blockquote>`,
+		class,
+		width,
+		renderFacetsHTML(post.Record.Text, post.Record.Facets),
+		html.EscapeString(name),
+		html.EscapeString(post.Author.Handle),
+		html.EscapeString(permalink),
+		createdAt.Format("2006-01-02T15:04:05-07:00"),
+		createdAt.Format("January 2, 2006"),
+	)
+	if !parseTwitterBool(c.Query("omit_script"), false) {
+		embedHTML += "\n" + `<script src="//platform.twitter.com/widgets.js" charset="utf-8"></script>`
+	}
+
+	return c.JSON(bridge.OEmbed{
+		CacheAge:     "31536000",
+		URL:          permalink,
+		ProviderURL:  "https://bsky.app",
+		ProviderName: "Bluesky",
+		AuthorName:   name,
+		Version:      "1.0",
+		AuthorURL:    authorURL,
+		Type:         "rich",
+		HTML:         embedHTML,
+		Height:       nil,
+		Width:        width,
+	})
+}
@@ -1,10 +1,12 @@
 package twitterv1
 
 import (
-	"fmt"
+	"html"
 	"math/big"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
@@ -19,78 +21,96 @@ func home_timeline(c *fiber.Ctx) error {
 	user_did, session_uuid, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
 	encryptionKey, err := GetEncryptionKeyFromRequest(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
+	}
+
+	query, err := parseTimelineQuery(c)
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
 	// Check for context
-	max_id := c.Query("max_id")
 	context := ""
 
 	// Handle getting things in the past
-	if max_id != "" {
-		// Get the timeline context from the DB
-		maxIDBigInt, ok := new(big.Int).SetString(max_id, 10)
-		if !ok {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid max_id format")
-		}
-		maxID, _, _ := bridge.TwitterMsgIdToBluesky(maxIDBigInt)
-		fmt.Println("Max ID: " + maxID)
-		contextPtr, err := db_controller.GetTimelineContext(*user_did, *session_uuid, *maxIDBigInt, *encryptionKey)
+	if query.MaxID != nil {
+		// Get the timeline context from the DB. If we don't have one, we start from the top, and skip until we reach max_id.
+		contextPtr, err := db_controller.GetTimelineContext(*user_did, *session_uuid, *query.MaxID, *encryptionKey)
 		if err == nil {
 			context = *contextPtr
 		}
 	}
 
-	err, res := blueskyapi.GetTimeline(*oauthToken, context)
+	tweets, cursor, err := fetchTimeline(query, func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		err, res := blueskyapi.GetTimeline(c.UserContext(), *oauthToken, cursor, limit)
+		return res, err
+	}, context)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to fetch timeline", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch timeline")
 	}
 
-	// Translate the posts to tweets
-	tweets := []bridge.Tweet{}
+	// Store the oldest message id, along with our context in the DB
+	if len(tweets) > 0 {
+		oldestTweet := tweets[len(tweets)-1]
+		err = db_controller.SetTimelineContext(*user_did, *session_uuid, oldestTweet.ID, cursor, *encryptionKey)
 
-	for _, item := range res.Feed {
-		tweets = append(tweets, TranslatePostToTweet(item.Post, item.Reply.Parent.URI, item.Reply.Parent.Author.DID, &item.Reply.Parent.Record.CreatedAt, item.Reason))
+		if err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to save timeline context", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to save timeline context")
+		}
 	}
 
-	// Store the oldest message id, along with our context in the DB
-	oldestTweet := tweets[0]
-	for _, tweet := range tweets {
+	return c.JSON(formatTimeline(tweets, query))
 
-		// TODO: Remove this later once retweets are working better
-		if tweet.RetweetedStatus != nil {
-			continue
-		}
+}
 
-		tweetTime, err := bridge.TwitterTimeParser(tweet.CreatedAt)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to parse tweet time")
-		}
-		oldestTweetTime, err := bridge.TwitterTimeParser(oldestTweet.CreatedAt)
+// The public timeline is the same for everyone, and doesn't need a login, so we only fetch it every so often.
+const publicTimelineCacheTTL = time.Minute
+
+var (
+	publicTimelineCache        []bridge.Tweet
+	publicTimelineCacheExpires time.Time
+	publicTimelineCacheMutex   sync.Mutex
+)
+
+// https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/get/statuses/public_timeline
+// Bluesky doesn't have a public timeline, so we show a feed that the instance owner picked instead.
+func public_timeline(c *fiber.Ctx) error {
+	publicTimelineCacheMutex.Lock()
+	defer publicTimelineCacheMutex.Unlock()
+
+	if publicTimelineCache == nil || publicTimelineCacheExpires.Before(time.Now()) {
+		res, err := blueskyapi.GetFeed(c.UserContext(), "", configData.PublicTimelineFeed, 20, "")
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Failed to parse oldest tweet time")
+			log.ErrorContext(c.UserContext(), "Failed to fetch timeline", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch timeline")
 		}
-		if tweetTime.Before(oldestTweetTime) {
-			oldestTweet = tweet
+
+		tweets := []bridge.Tweet{}
+		for _, item := range res.Feed {
+			tweets = append(tweets, TranslatePostToTweet(item.Post, item.Reply.Parent.URI, item.Reply.Parent.Author.DID, &item.Reply.Parent.Record.CreatedAt, item.Reason))
 		}
+
+		publicTimelineCache = tweets
+		publicTimelineCacheExpires = time.Now().Add(publicTimelineCacheTTL)
 	}
-	err = db_controller.SetTimelineContext(*user_did, *session_uuid, oldestTweet.ID, res.Cursor, *encryptionKey)
 
+	// Twitter ignored everything except trim_user & include_entities here
+	query, err := parseTimelineQuery(c)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to save timeline context")
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
 	}
 
-	return c.JSON(tweets)
-
+	return c.JSON(formatTimeline(publicTimelineCache, query))
 }
 
 // https://web.archive.org/web/20120708204036/https://dev.twitter.com/docs/api/1/get/statuses/show/%3Aid
@@ -105,10 +125,10 @@ func GetStatusFromId(c *fiber.Ctx) error {
 	_, _, oauthToken, err := GetAuthFromReq(c)
 
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header")
+		return authError(c, err)
 	}
 
-	err, thread := blueskyapi.GetPost(*oauthToken, uri, 0, 1)
+	err, thread := blueskyapi.GetPost(c.UserContext(), *oauthToken, uri, 0, 1)
 
 	if err != nil {
 		return err
@@ -117,6 +137,19 @@ func GetStatusFromId(c *fiber.Ctx) error {
 	return c.JSON(TranslatePostToTweet(thread.Thread.Post, "", "", nil, nil))
 }
 
+// tweetSource gets the app a post was made with, in the format twitter used for "via".
+// Posts from registered apps link to the app, other posts use whatever the client put in the record.
+func tweetSource(record blueskyapi.PostRecord) string {
+	if record.Via == "" {
+		return "Bluesky"
+	}
+	// Anyone can put anything in a record, so we only link to websites.
+	if !strings.HasPrefix(record.ViaURL, "https://") && !strings.HasPrefix(record.ViaURL, "http://") {
+		return html.EscapeString(record.Via)
+	}
+	return `<a href="` + html.EscapeString(record.ViaURL) + `" rel="nofollow">` + html.EscapeString(record.Via) + `</a>`
+}
+
 func TranslatePostToTweet(tweet blueskyapi.Post, replyMsgBskyURI string, replyUserBskyId string, replyTimeStamp *time.Time, postReason *blueskyapi.PostReason) bridge.Tweet {
 	tweetEntities := bridge.Entities{
 		Hashtags:     nil,
@@ -133,6 +166,8 @@ func TranslatePostToTweet(tweet blueskyapi.Post, replyMsgBskyURI string, replyUs
 			ID:       *big.NewInt(int64(id)),
 			IDStr:    strconv.Itoa(id),
 			MediaURL: "http://10.0.0.77:3000/cdn/img/?url=" + url.QueryEscape("https://cdn.bsky.app/img/feed_thumbnail/plain/"+tweet.Author.DID+"/"+image.Image.Ref.Link+"/@jpeg"),
+			Sizes:    bridge.MediaSizesFor(image.AspectRatio.Width, image.AspectRatio.Height),
+			Type:     "photo",
 			// MediaURLHttps: "https://10.0.0.77:3000/cdn/img/?url=" + url.QueryEscape("https://cdn.bsky.app/img/feed_thumbnail/plain/did:plc:"+image.Image.Ref.Link+"@jpeg"),
 		})
 		id++
@@ -277,7 +312,7 @@ func TranslatePostToTweet(tweet blueskyapi.Post, replyMsgBskyURI string, replyUs
 			// FriendsCount:    100,
 			// StatusesCount:   333,
 		},
-		Source: "Bluesky",
+		Source: tweetSource(tweet.Record),
 		InReplyToStatusID: func() *big.Int {
 			if replyTimeStamp == nil {
 				return nil
@@ -311,7 +346,7 @@ func TranslatePostToTweet(tweet blueskyapi.Post, replyMsgBskyURI string, replyUs
 func TweetInfo(c *fiber.Ctx) error {
 	_, _, oauthToken, err := GetAuthFromReq(c)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).SendString("OAuth token not found in Authorization header (yes i know this isn't complient with the twitter api)")
+		return authError(c, err)
 	}
 
 	encodedId := c.Params("id")
@@ -321,19 +356,19 @@ func TweetInfo(c *fiber.Ctx) error {
 	}
 	id, _, _ := bridge.TwitterMsgIdToBluesky(idBigInt)
 
-	err, thread := blueskyapi.GetPost(*oauthToken, id, 1, 0)
+	err, thread := blueskyapi.GetPost(c.UserContext(), *oauthToken, id, 1, 0)
 
 	if err != nil {
 		return err
 	}
 
-	likes, err := blueskyapi.GetLikes(*oauthToken, id, 100)
+	likes, err := blueskyapi.GetLikes(c.UserContext(), *oauthToken, id, 100)
 
 	if err != nil {
 		return err
 	}
 
-	reposters, err := blueskyapi.GetRetweetAuthors(*oauthToken, id, 100)
+	reposters, err := blueskyapi.GetRetweetAuthors(c.UserContext(), *oauthToken, id, 100)
 
 	if err != nil {
 		return err
@@ -0,0 +1,271 @@
+package twitterv1
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"unicode/utf8"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+	"github.com/nfnt/resize"
+)
+
+// Bluesky's limits on the profile record. These are technically in graphemes, but runes are close enough.
+const (
+	maxDisplayNameLength = 64
+	maxDescriptionLength = 256
+)
+
+// Twitter's limits on uploaded images, and what we scale them to before sending them to bluesky.
+// Bluesky's banners are 3:1 just like twitter's, so they can be used as is.
+const (
+	maxProfileImageSize = 700 * 1024
+	maxBannerSize       = 5 * 1024 * 1024
+	maxImageDimension   = 4096 // Images are decoded in full before we scale them down, so this stops a small file from taking up gigabytes
+
+	// Base64 makes uploads a third bigger, plus some room for the rest of the form.
+	// Anything bigger than this is turned away before our own size checks get to give the client a twitter error.
+	maxRequestBodySize = maxBannerSize*4/3 + 1024*1024
+
+	profileImageSize = 500
+	bannerWidth      = 1500
+	bannerHeight     = 500
+)
+
+var (
+	errImageTooLarge           = errors.New("image too large")
+	errImageDimensionsTooLarge = errors.New("image dimensions too large")
+	errImageUnreadable         = errors.New("image could not be processed")
+
+	errNameTooLong        = errors.New("name is too long")
+	errDescriptionTooLong = errors.New("description, location and url are too long")
+)
+
+// optionalFormValue gets a form value, but lets us tell the difference between a missing value, and one that was set to nothing.
+func optionalFormValue(c *fiber.Ctx, key string) *string {
+	if !c.Request().PostArgs().Has(key) && !c.Request().URI().QueryArgs().Has(key) {
+		return nil
+	}
+	value := c.FormValue(key)
+	return &value
+}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/post/account/update_profile
+func UpdateProfile(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	name := optionalFormValue(c, "name")
+	profileURL := optionalFormValue(c, "url")
+	location := optionalFormValue(c, "location")
+	description := optionalFormValue(c, "description")
+
+	err = blueskyapi.UpdateProfile(c.UserContext(), *oauthToken, *user_did, func(profile map[string]interface{}) error {
+		if name != nil {
+			if utf8.RuneCountInString(*name) > maxDisplayNameLength {
+				return errNameTooLong
+			}
+			profile["displayName"] = *name
+		}
+
+		// The URL & location live inside of the description, so we have to rebuild it if any of them change.
+		if profileURL != nil || location != nil || description != nil {
+			currentDescription, _ := profile["description"].(string)
+			bio, currentLocation, currentURL := bridge.ParseProfileDescription(currentDescription)
+			if description != nil {
+				bio = *description
+			}
+			if location != nil {
+				currentLocation = *location
+			}
+			if profileURL != nil {
+				currentURL = *profileURL
+			}
+
+			newDescription := bridge.BuildProfileDescription(bio, currentLocation, currentURL)
+			if utf8.RuneCountInString(newDescription) > maxDescriptionLength {
+				return errDescriptionTooLong
+			}
+			profile["description"] = newDescription
+		}
+		return nil
+	})
+
+	if err != nil {
+		return profileUpdateError(c, err)
+	}
+
+	userinfo, err := blueskyapi.GetUserInfo(c.UserContext(), *oauthToken, *user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch user info", "error", err)
+		return ReturnError(c, "Internal error", errorCodeInternalError, fiber.StatusInternalServerError)
+	}
+
+	return c.JSON(userinfo)
+}
+
+// profileUpdateError sends the client a twitter error for why updating their profile failed.
+// Bluesky's own error messages aren't passed on, as they can have details about the PDS in them.
+func profileUpdateError(c *fiber.Ctx, err error) error {
+	switch err {
+	case errNameTooLong:
+		return ReturnError(c, fmt.Sprintf("Account update failed: Name is too long (maximum is %d characters)", maxDisplayNameLength), errorCodeAccountUpdateFailed, fiber.StatusForbidden)
+	case errDescriptionTooLong:
+		return ReturnError(c, fmt.Sprintf("Account update failed: Description, location and url are too long together (maximum is %d characters)", maxDescriptionLength), errorCodeAccountUpdateFailed, fiber.StatusForbidden)
+	case blueskyapi.ErrInvalidSwap:
+		return ReturnError(c, "Account update failed: Your profile was changed somewhere else at the same time, try again", errorCodeAccountUpdateFailed, fiber.StatusConflict)
+	case blueskyapi.ErrUnauthorized:
+		return ReturnError(c, "Invalid or expired token", errorCodeInvalidToken, fiber.StatusUnauthorized)
+	default:
+		log.ErrorContext(c.UserContext(), "Failed to update profile", "error", err)
+		return ReturnError(c, "Internal error", errorCodeInternalError, fiber.StatusInternalServerError)
+	}
+}
+
+// readUploadedImage gets an image from either a multipart file, or base64 encoded in a form value. Twitter allowed both.
+func readUploadedImage(c *fiber.Ctx, key string, maxSize int) ([]byte, error) {
+	if file, err := c.FormFile(key); err == nil {
+		if file.Size > int64(maxSize) {
+			return nil, errImageTooLarge
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, errImageUnreadable
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+
+	encoded := c.FormValue(key)
+	if encoded == "" {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+	if len(data) > maxSize {
+		return nil, errImageTooLarge
+	}
+	return data, nil
+}
+
+// transcodeImage center crops an image to the aspect ratio of width:height, resizes it to width x height, and re-encodes it as a JPEG.
+func transcodeImage(data []byte, width int, height int) ([]byte, error) {
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+	if imageConfig.Width > maxImageDimension || imageConfig.Height > maxImageDimension {
+		return nil, errImageDimensionsTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageUnreadable
+	}
+
+	img = centerCrop(img, width, height)
+
+	if img.Bounds().Dx() > width {
+		img = resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadProfileImage handles everything shared between uploading avatars and banners.
+// It returns the blob that was set on the profile, or sends an error to the client and returns nil.
+func uploadProfileImage(c *fiber.Ctx, user_did string, oauthToken string, formKey string, profileKey string, maxSize int, width int, height int) (*blueskyapi.Blob, error) {
+	data, err := readUploadedImage(c, formKey, maxSize)
+	if err == errImageTooLarge {
+		return nil, ReturnError(c, fmt.Sprintf("Image file size must be <= %d bytes", maxSize), errorCodeInvalidImage, fiber.StatusUnprocessableEntity)
+	}
+	if err != nil {
+		return nil, ReturnError(c, "Image could not be processed", errorCodeInvalidImage, fiber.StatusBadRequest)
+	}
+	if data == nil {
+		return nil, ReturnError(c, formKey+" parameter is missing", errorCodeMissingParameter, fiber.StatusBadRequest)
+	}
+
+	transcoded, err := transcodeImage(data, width, height)
+	if err == errImageDimensionsTooLarge {
+		return nil, ReturnError(c, fmt.Sprintf("Image dimensions must be <= %dx%d", maxImageDimension, maxImageDimension), errorCodeInvalidImage, fiber.StatusUnprocessableEntity)
+	}
+	if err != nil {
+		return nil, ReturnError(c, "Image could not be processed", errorCodeInvalidImage, fiber.StatusBadRequest)
+	}
+
+	blob, err := blueskyapi.UploadBlob(c.UserContext(), oauthToken, transcoded, "image/jpeg")
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to upload image", "error", err)
+		return nil, c.Status(fiber.StatusInternalServerError).SendString("Failed to upload image")
+	}
+
+	err = blueskyapi.UpdateProfile(c.UserContext(), oauthToken, user_did, func(profile map[string]interface{}) error {
+		profile[profileKey] = blob
+		return nil
+	})
+	if err != nil {
+		return nil, profileUpdateError(c, err)
+	}
+
+	return blob, nil
+}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/post/account/update_profile_image
+func UpdateProfileImage(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	blob, err := uploadProfileImage(c, *user_did, *oauthToken, "image", "avatar", maxProfileImageSize, profileImageSize, profileImageSize)
+	if blob == nil {
+		return err
+	}
+
+	userinfo, err := blueskyapi.GetUserInfo(c.UserContext(), *oauthToken, *user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch user info", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch user info")
+	}
+
+	// The app view might not have seen our new avatar yet, so we point to it ourselves.
+	userinfo.ProfileImageURL = serverURL(c) + "/cdn/img/?url=" + url.QueryEscape(blueskyapi.AvatarURL(*user_did, blob.Ref.Link)) + ":thumb"
+
+	return c.JSON(userinfo)
+}
+
+// https://web.archive.org/web/20120620000000/https://dev.twitter.com/docs/api/1/post/account/update_profile_banner
+func UpdateProfileBanner(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	blob, err := uploadProfileImage(c, *user_did, *oauthToken, "banner", "banner", maxBannerSize, bannerWidth, bannerHeight)
+	if blob == nil {
+		return err
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
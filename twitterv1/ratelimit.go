@@ -0,0 +1,149 @@
+package twitterv1
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Twitter gave each token 350 requests an hour, and 150 to each IP for requests without one.
+// Bluesky's limits are much higher, but clients were built around these.
+const (
+	rateLimitHourlyLimit       = 350
+	rateLimitUnauthHourlyLimit = 150
+	rateLimitWindow            = time.Hour
+	rateLimitUnauthKeyPrefix   = "ip:" // Unauthenticated usage is kept alongside tokens' usage, under the IP
+)
+
+// rateLimitUsage is how much a single token, or IP, has used this window.
+type rateLimitUsage struct {
+	limit     int
+	calls     int
+	families  map[string]int
+	resetTime time.Time
+	upstream  *blueskyapi.RateLimit
+}
+
+var (
+	rateLimitUsages      = map[string]*rateLimitUsage{}
+	rateLimitUsagesMutex sync.Mutex
+)
+
+type RateLimitStatus struct {
+	RemainingHits       int            `json:"remaining_hits" xml:"remaining-hits"`
+	ResetTimeInSeconds  int64          `json:"reset_time_in_seconds" xml:"reset-time-in-seconds"`
+	HourlyLimit         int            `json:"hourly_limit" xml:"hourly-limit"`
+	ResetTime           string         `json:"reset_time" xml:"reset-time"`
+	EndpointFamilyCalls map[string]int `json:"endpoint_families" xml:"-"`
+}
+
+// endpointFamily gets which group of endpoints a path is in, eg. /1/statuses/home_timeline.json is in "statuses"
+func endpointFamily(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) >= 2 {
+		return strings.TrimSuffix(strings.TrimSuffix(segments[1], ".json"), ".xml")
+	}
+	return segments[0]
+}
+
+// getRateLimitUsage gets the usage for a token (or IP), starting a new window if the old one is over. rateLimitUsagesMutex must be held.
+func getRateLimitUsage(key string, limit int) *rateLimitUsage {
+	usage, ok := rateLimitUsages[key]
+	if !ok || usage.resetTime.Before(time.Now()) {
+		// Clean up everyone else's old windows while we're here
+		for otherKey, otherUsage := range rateLimitUsages {
+			if otherUsage.resetTime.Before(time.Now()) {
+				delete(rateLimitUsages, otherKey)
+			}
+		}
+
+		usage = &rateLimitUsage{
+			limit:     limit,
+			families:  map[string]int{},
+			resetTime: time.Now().Add(rateLimitWindow),
+		}
+		rateLimitUsages[key] = usage
+	}
+	return usage
+}
+
+// remaining works out how many calls a token has left, and when that resets.
+// If bluesky is going to run out before we do, we report bluesky's limit, so that clients back off in time.
+func (usage *rateLimitUsage) remaining() (int, time.Time) {
+	remaining := usage.limit - usage.calls
+	if remaining < 0 {
+		remaining = 0
+	}
+	resetTime := usage.resetTime
+
+	if usage.upstream != nil && usage.upstream.Reset.After(time.Now()) && usage.upstream.Remaining < remaining {
+		remaining = usage.upstream.Remaining
+		resetTime = usage.upstream.Reset
+	}
+	return remaining, resetTime
+}
+
+// RateLimitMiddleware counts every request against the token that made it, or the IP if there wasn't one, and tells the client how much they have left.
+// The token is only known once GetAuthFromReq has run, so this happens after the request is handled.
+func RateLimitMiddleware(c *fiber.Ctx) error {
+	err := c.Next()
+
+	key, limit := rateLimitUnauthKeyPrefix+c.IP(), rateLimitUnauthHourlyLimit
+	if tokenUUID, ok := c.Locals("token_uuid").(string); ok {
+		key, limit = tokenUUID, rateLimitHourlyLimit
+	}
+	accessToken, _ := c.Locals("access_token").(string)
+
+	rateLimitUsagesMutex.Lock()
+	defer rateLimitUsagesMutex.Unlock()
+
+	usage := getRateLimitUsage(key, limit)
+	// Checking the rate limit doesn't count against it.
+	if !strings.HasPrefix(c.Path(), "/1/account/rate_limit_status") {
+		usage.calls++
+		usage.families[endpointFamily(c.Path())]++
+	}
+	if accessToken != "" {
+		if upstream := blueskyapi.GetRateLimit(accessToken); upstream != nil {
+			usage.upstream = upstream
+		}
+	}
+
+	remaining, resetTime := usage.remaining()
+	c.Set("X-RateLimit-Limit", strconv.Itoa(usage.limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Set("X-RateLimit-Reset", strconv.FormatInt(resetTime.Unix(), 10))
+
+	return err
+}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/get/account/rate_limit_status
+func RateLimitStatusHandler(c *fiber.Ctx) error {
+	_, tokenUUID, _, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	rateLimitUsagesMutex.Lock()
+	usage := getRateLimitUsage(*tokenUUID, rateLimitHourlyLimit)
+	remaining, resetTime := usage.remaining()
+	families := map[string]int{}
+	for family, calls := range usage.families {
+		families[family] = calls
+	}
+	rateLimitUsagesMutex.Unlock()
+
+	return c.JSON(RateLimitStatus{
+		RemainingHits:       remaining,
+		ResetTimeInSeconds:  resetTime.Unix(),
+		HourlyLimit:         rateLimitHourlyLimit,
+		ResetTime:           bridge.TwitterTimeConverter(resetTime.UTC()),
+		EndpointFamilyCalls: families,
+	})
+}
@@ -0,0 +1,132 @@
+package twitterv1
+
+import (
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/gofiber/fiber/v2"
+)
+
+const reasonRepost = "app.bsky.feed.defs#reasonRepost"
+
+// repostsOnly wraps a timeline so that only the reposts that keep returns true for are left in each page.
+func repostsOnly(fetch timelinePageFetcher, keep func(reason *blueskyapi.PostReason) bool) timelinePageFetcher {
+	return func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		res, err := fetch(cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		feed := []blueskyapi.Feed{}
+		for _, item := range res.Feed {
+			if item.Reason != nil && item.Reason.Type == reasonRepost && keep(item.Reason) {
+				feed = append(feed, item)
+			}
+		}
+		return &blueskyapi.Timeline{Feed: feed, Cursor: res.Cursor}, nil
+	}
+}
+
+// sendRetweetTimeline handles everything shared between the retweet timelines.
+// We don't keep a cursor in the DB for these, so max_id is found by skipping through pages from the top.
+func sendRetweetTimeline(c *fiber.Ctx, fetch timelinePageFetcher) error {
+	query, err := parseTimelineQuery(c)
+
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	// Everything here is a retweet, so include_rts makes no sense.
+	query.IncludeRetweets = true
+
+	tweets, _, err := fetchTimeline(query, fetch, "")
+
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch timeline", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch timeline")
+	}
+
+	return c.JSON(formatTimeline(tweets, query))
+}
+
+// https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/get/statuses/retweets_of_me
+// Bluesky tells us about reposts through notifications, which only have the URI of the post, so we have to look the posts up.
+func RetweetsOfMe(c *fiber.Ctx) error {
+	_, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	return sendRetweetTimeline(c, func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		notifications, err := blueskyapi.ListNotifications(c.UserContext(), *oauthToken, []string{"repost"}, limit, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		uris := []string{}
+		for _, notification := range notifications.Notifications {
+			if notification.Reason == "repost" {
+				uris = append(uris, notification.ReasonSubject)
+			}
+		}
+
+		posts := map[string]blueskyapi.Post{}
+		for _, group := range groupUsers(uris, 25) {
+			groupPosts, err := blueskyapi.GetPosts(c.UserContext(), *oauthToken, group)
+			if err != nil {
+				return nil, err
+			}
+			for _, post := range groupPosts {
+				posts[post.URI] = post
+			}
+		}
+
+		feed := []blueskyapi.Feed{}
+		for _, notification := range notifications.Notifications {
+			post, ok := posts[notification.ReasonSubject]
+			if notification.Reason != "repost" || !ok {
+				continue
+			}
+			feed = append(feed, blueskyapi.Feed{
+				Post: post,
+				Reason: &blueskyapi.PostReason{
+					Type:      reasonRepost,
+					By:        notification.Author,
+					IndexedAt: notification.IndexedAt,
+				},
+			})
+		}
+
+		return &blueskyapi.Timeline{Feed: feed, Cursor: notifications.Cursor}, nil
+	})
+}
+
+// https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/get/statuses/retweeted_by_me
+func RetweetedByMe(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	return sendRetweetTimeline(c, repostsOnly(func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		return blueskyapi.GetAuthorFeed(c.UserContext(), *oauthToken, *user_did, limit, cursor)
+	}, func(reason *blueskyapi.PostReason) bool {
+		return reason.By.DID == *user_did
+	}))
+}
+
+// https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/get/statuses/retweeted_to_me
+func RetweetedToMe(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	return sendRetweetTimeline(c, repostsOnly(func(cursor string, limit int) (*blueskyapi.Timeline, error) {
+		err, res := blueskyapi.GetTimeline(c.UserContext(), *oauthToken, cursor, limit)
+		return res, err
+	}, func(reason *blueskyapi.PostReason) bool {
+		return reason.By.DID != *user_did
+	}))
+}
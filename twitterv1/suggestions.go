@@ -0,0 +1,201 @@
+package twitterv1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Bluesky's suggested follows get their own category, every other category is a starter pack.
+const suggestedCategorySlug = "suggested"
+
+type SuggestionCategory struct {
+	Name  string               `json:"name"`
+	Slug  string               `json:"slug"`
+	Size  int                  `json:"size"`
+	Users []bridge.TwitterUser `json:"users,omitempty"`
+}
+
+type Recommendation struct {
+	UserID string             `json:"user_id"`
+	User   bridge.TwitterUser `json:"user"`
+}
+
+// Starter packs don't have slugs, so we use the URI of the starter pack instead.
+func starterPackToSlug(uri string) string {
+	return bridge.Base64URLEncode(uri)
+}
+
+func slugToStarterPack(slug string) (string, error) {
+	uri, err := bridge.Base64URLDecode(slug)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(uri, "at://") || !strings.Contains(uri, "/app.bsky.graph.starterpack/") {
+		return "", fmt.Errorf("invalid starter pack slug")
+	}
+	return uri, nil
+}
+
+// getStarterPacksForUser gets the starter packs that the user has either joined with, or created themselves.
+func getStarterPacksForUser(ctx context.Context, token string, user_did string) ([]blueskyapi.StarterPack, error) {
+	starterPacks := []blueskyapi.StarterPack{}
+
+	profile, err := blueskyapi.GetProfile(ctx, token, user_did)
+	if err != nil {
+		return nil, err
+	}
+	if profile.JoinedViaStarterPack != nil {
+		starterPacks = append(starterPacks, *profile.JoinedViaStarterPack)
+	}
+
+	createdStarterPacks, err := blueskyapi.GetActorStarterPacks(ctx, token, user_did, 25)
+	if err != nil {
+		return nil, err
+	}
+	for _, starterPack := range createdStarterPacks.StarterPacks {
+		if profile.JoinedViaStarterPack != nil && starterPack.URI == profile.JoinedViaStarterPack.URI {
+			continue
+		}
+		starterPacks = append(starterPacks, starterPack)
+	}
+
+	return starterPacks, nil
+}
+
+// https://web.archive.org/web/20120516154953/https://dev.twitter.com/docs/api/1/get/users/suggestions
+func SuggestionCategories(c *fiber.Ctx) error {
+	user_did, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	suggestions, err := blueskyapi.GetSuggestions(c.UserContext(), *oauthToken, 50)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch suggestions", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch suggestions")
+	}
+
+	categories := []SuggestionCategory{
+		{
+			Name: "Suggested for you",
+			Slug: suggestedCategorySlug,
+			Size: len(suggestions.Actors),
+		},
+	}
+
+	starterPacks, err := getStarterPacksForUser(c.UserContext(), *oauthToken, *user_did)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch starter packs", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch starter packs")
+	}
+	for _, starterPack := range starterPacks {
+		categories = append(categories, SuggestionCategory{
+			Name: starterPack.Record.Name,
+			Slug: starterPackToSlug(starterPack.URI),
+			Size: starterPack.ListItemCount,
+		})
+	}
+
+	return c.JSON(categories)
+}
+
+// https://web.archive.org/web/20120516160451/https://dev.twitter.com/docs/api/1/get/users/suggestions/%3Aslug
+func SuggestionCategoryUsers(c *fiber.Ctx) error {
+	_, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	slug := c.Params("slug")
+
+	if slug == suggestedCategorySlug {
+		suggestions, err := blueskyapi.GetSuggestions(c.UserContext(), *oauthToken, 50)
+		if err != nil {
+			log.ErrorContext(c.UserContext(), "Failed to fetch suggestions", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch suggestions")
+		}
+
+		users := []bridge.TwitterUser{}
+		for _, actor := range suggestions.Actors {
+			users = append(users, *blueskyapi.AuthorTTB(actor))
+		}
+
+		return c.JSON(SuggestionCategory{
+			Name:  "Suggested for you",
+			Slug:  suggestedCategorySlug,
+			Size:  len(users),
+			Users: users,
+		})
+	}
+
+	starterPackURI, err := slugToStarterPack(slug)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Unknown category")
+	}
+
+	starterPack, err := blueskyapi.GetStarterPack(c.UserContext(), *oauthToken, starterPackURI)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch starter pack", "error", err)
+		return c.Status(fiber.StatusNotFound).SendString("Unknown category")
+	}
+	if starterPack.List == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Unknown category")
+	}
+
+	list, err := blueskyapi.GetList(c.UserContext(), *oauthToken, starterPack.List.URI, 100)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch starter pack users", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch starter pack users")
+	}
+
+	users := []bridge.TwitterUser{}
+	for _, item := range list.Items {
+		users = append(users, *blueskyapi.AuthorTTB(item.Subject))
+	}
+
+	return c.JSON(SuggestionCategory{
+		Name:  starterPack.Record.Name,
+		Slug:  slug,
+		Size:  starterPack.List.ListItemCount,
+		Users: users,
+	})
+}
+
+// This one was never documented, but it returns the users that twitter recommends, without any categories.
+// We use the same suggestions as the "Suggested for you" category.
+func UserRecommendations(c *fiber.Ctx) error {
+	_, _, oauthToken, err := GetAuthFromReq(c)
+
+	if err != nil {
+		return authError(c, err)
+	}
+
+	limit := c.QueryInt("limit", 20)
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	suggestions, err := blueskyapi.GetSuggestions(c.UserContext(), *oauthToken, limit)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch suggestions", "error", err)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch suggestions")
+	}
+
+	recommendations := []Recommendation{}
+	for _, actor := range suggestions.Actors {
+		user := blueskyapi.AuthorTTB(actor)
+		recommendations = append(recommendations, Recommendation{
+			UserID: user.ID.String(),
+			User:   *user,
+		})
+	}
+
+	return c.JSON(recommendations)
+}
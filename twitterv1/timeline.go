@@ -0,0 +1,195 @@
+package twitterv1
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Twitter's limits on how many tweets a timeline request can return
+const (
+	defaultTimelineCount = 20
+	maxTimelineCount     = 200
+	// We stop asking bluesky for more pages after this, so a picky filter can't make us fetch forever.
+	maxTimelinePages = 10
+	// The most bluesky will give us per page
+	maxTimelinePageSize = 100
+)
+
+// TimelineQuery is the query parameters that every timeline endpoint shares.
+// https://web.archive.org/web/20120508224719/https://dev.twitter.com/docs/api/1/get/statuses/home_timeline
+type TimelineQuery struct {
+	Count           int
+	SinceID         *big.Int
+	MaxID           *big.Int
+	TrimUser        bool
+	IncludeEntities bool
+	ExcludeReplies  bool
+	IncludeRetweets bool
+}
+
+// A function that gets a single page of a timeline from bluesky, starting at cursor.
+type timelinePageFetcher func(cursor string, limit int) (*blueskyapi.Timeline, error)
+
+// A tweet with the parts the client didn't ask for taken out.
+// When encoding, the fields here take priority over the ones with the same name in Tweet.
+type timelineTweet struct {
+	bridge.Tweet
+	User            interface{}      `json:"user"`
+	Entities        *bridge.Entities `json:"entities,omitempty"`
+	RetweetedStatus *timelineTweet   `json:"retweeted_status,omitempty"`
+}
+
+// The user object for trim_user, which only has the ID
+type trimmedUser struct {
+	ID    big.Int `json:"id"`
+	IDStr string  `json:"id_str"`
+}
+
+// parseTwitterBool parses a boolean the way twitter did, where true, t and 1 are all true.
+func parseTwitterBool(value string, defaultValue bool) bool {
+	switch value {
+	case "true", "t", "1":
+		return true
+	case "false", "f", "0":
+		return false
+	}
+	return defaultValue
+}
+
+func parseTimelineQuery(c *fiber.Ctx) (*TimelineQuery, error) {
+	query := &TimelineQuery{
+		Count:           c.QueryInt("count", defaultTimelineCount),
+		TrimUser:        parseTwitterBool(c.Query("trim_user"), false),
+		IncludeEntities: parseTwitterBool(c.Query("include_entities"), true),
+		ExcludeReplies:  parseTwitterBool(c.Query("exclude_replies"), false),
+		IncludeRetweets: parseTwitterBool(c.Query("include_rts"), true),
+	}
+
+	if query.Count <= 0 {
+		query.Count = defaultTimelineCount
+	}
+	if query.Count > maxTimelineCount {
+		query.Count = maxTimelineCount
+	}
+
+	if sinceID := c.Query("since_id"); sinceID != "" {
+		id, ok := new(big.Int).SetString(sinceID, 10)
+		if !ok {
+			return nil, errors.New("invalid since_id format")
+		}
+		query.SinceID = id
+	}
+	if maxID := c.Query("max_id"); maxID != "" {
+		id, ok := new(big.Int).SetString(maxID, 10)
+		if !ok {
+			return nil, errors.New("invalid max_id format")
+		}
+		query.MaxID = id
+	}
+
+	return query, nil
+}
+
+// tweetIDTime gets the time that is stored at the start of every tweet ID.
+func tweetIDTime(id *big.Int) time.Time {
+	_, idTime, _ := bridge.TwitterMsgIdToBluesky(new(big.Int).Set(id))
+	return idTime
+}
+
+// fetchTimeline keeps getting pages from bluesky until it has enough tweets to fill the query, or runs out of tweets.
+// Returns the tweets, and the cursor to get the tweets after them.
+func fetchTimeline(query *TimelineQuery, fetch timelinePageFetcher, cursor string) ([]bridge.Tweet, string, error) {
+	var sinceTime, maxTime *time.Time
+	if query.SinceID != nil {
+		t := tweetIDTime(query.SinceID)
+		sinceTime = &t
+	}
+	if query.MaxID != nil {
+		t := tweetIDTime(query.MaxID)
+		maxTime = &t
+	}
+
+	tweets := []bridge.Tweet{}
+	for page := 0; page < maxTimelinePages; page++ {
+		limit := query.Count - len(tweets)
+		if limit > maxTimelinePageSize {
+			limit = maxTimelinePageSize
+		}
+
+		res, err := fetch(cursor, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		cursor = res.Cursor
+
+		reachedSince := false
+		for _, item := range res.Feed {
+			if query.ExcludeReplies && item.Reply.Parent.URI != "" {
+				continue
+			}
+			if !query.IncludeRetweets && item.Reason != nil {
+				continue
+			}
+
+			tweet := TranslatePostToTweet(item.Post, item.Reply.Parent.URI, item.Reply.Parent.Author.DID, &item.Reply.Parent.Record.CreatedAt, item.Reason)
+
+			tweetTime := tweetIDTime(&tweet.ID)
+			if maxTime != nil && tweetTime.After(*maxTime) {
+				continue
+			}
+			if sinceTime != nil && !tweetTime.After(*sinceTime) {
+				// Timelines are newest first, so everything after this is older too.
+				reachedSince = true
+				break
+			}
+
+			tweets = append(tweets, tweet)
+			if len(tweets) >= query.Count {
+				break
+			}
+		}
+
+		if reachedSince || len(tweets) >= query.Count || cursor == "" || len(res.Feed) == 0 {
+			break
+		}
+	}
+
+	return tweets, cursor, nil
+}
+
+// formatTimeline takes out anything from the tweets that the query asked us not to include.
+func formatTimeline(tweets []bridge.Tweet, query *TimelineQuery) []timelineTweet {
+	formatted := make([]timelineTweet, len(tweets))
+	for i, tweet := range tweets {
+		formatted[i] = formatTimelineTweet(tweet, query)
+	}
+	return formatted
+}
+
+func formatTimelineTweet(tweet bridge.Tweet, query *TimelineQuery) timelineTweet {
+	formatted := timelineTweet{
+		Tweet: tweet,
+		User:  tweet.User,
+	}
+
+	if query.TrimUser {
+		formatted.User = trimmedUser{
+			ID:    tweet.User.ID,
+			IDStr: tweet.User.ID.String(),
+		}
+	}
+	if query.IncludeEntities {
+		formatted.Entities = &tweet.Entities
+	}
+	if tweet.RetweetedStatus != nil {
+		retweetedStatus := formatTimelineTweet(*tweet.RetweetedStatus, query)
+		formatted.RetweetedStatus = &retweetedStatus
+	}
+
+	return formatted
+}
@@ -0,0 +1,151 @@
+package twitterv1
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Our oauth tokens have everything we need to find & decrypt a session:
+// "tb1.b64(DID).b64(UUID).b64(key).checksum", with unpadded URL safe base64.
+// The checksum catches tokens that got cut off or mangled, before we go looking for them.
+// Tokens from before this are "b64(DID).b64(UUID).key", and still work.
+const (
+	oauthTokenVersion  = "tb1"
+	oauthTokenChecksum = 6 // How many bytes of the SHA-256 we keep
+)
+
+var (
+	errOAuthTokenMissing   = errors.New("oauth token not found")
+	errOAuthTokenMalformed = errors.New("oauth token is malformed")
+	errOAuthTokenChecksum  = errors.New("oauth token checksum doesn't match")
+	errOAuthTokenVersion   = errors.New("oauth token version isn't supported")
+	errOAuthTokenUnknown   = errors.New("oauth token doesn't match a session")
+	errOAuthTokenWrongKey  = errors.New("oauth token can't decrypt its session")
+)
+
+// The errors that mean the client needs to log in again
+var invalidTokenErrors = []error{errOAuthTokenMalformed, errOAuthTokenChecksum, errOAuthTokenVersion, errOAuthTokenUnknown, errOAuthTokenWrongKey, errRefreshTokenExpired}
+
+type oauthToken struct {
+	DID           string
+	TokenUUID     string
+	EncryptionKey string // Standard base64, like bridge.Encrypt wants
+}
+
+func oauthTokenChecksumOf(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(sum[:oauthTokenChecksum])
+}
+
+// String encodes the token in the current format.
+func (token *oauthToken) String() string {
+	key, _ := base64.StdEncoding.DecodeString(token.EncryptionKey)
+	body := strings.Join([]string{
+		oauthTokenVersion,
+		base64.RawURLEncoding.EncodeToString([]byte(token.DID)),
+		base64.RawURLEncoding.EncodeToString([]byte(token.TokenUUID)),
+		base64.RawURLEncoding.EncodeToString(key),
+	}, ".")
+	return body + "." + oauthTokenChecksumOf(body)
+}
+
+// decodeTokenSegment decodes a segment of a token. Padding is optional, as old tokens had it on some segments.
+// Old tokens' keys could also be in the standard alphabet, which the original parser accepted too.
+func decodeTokenSegment(segment string) ([]byte, error) {
+	segment = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(segment, "="))
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || len(decoded) == 0 {
+		return nil, errOAuthTokenMalformed
+	}
+	return decoded, nil
+}
+
+// parseOAuthToken parses an oauth token, in either the current or the original format.
+func parseOAuthToken(raw string) (*oauthToken, error) {
+	segments := strings.Split(raw, ".")
+
+	var did, tokenUUID, key string
+	switch {
+	case len(segments) == 5 && segments[0] == oauthTokenVersion:
+		body := raw[:strings.LastIndex(raw, ".")]
+		if subtle.ConstantTimeCompare([]byte(oauthTokenChecksumOf(body)), []byte(segments[4])) != 1 {
+			return nil, errOAuthTokenChecksum
+		}
+		did, tokenUUID, key = segments[1], segments[2], segments[3]
+	case len(segments) == 3:
+		did, tokenUUID, key = segments[0], segments[1], segments[2]
+	case segments[0] == oauthTokenVersion:
+		return nil, errOAuthTokenMalformed
+	case strings.HasPrefix(segments[0], "tb"):
+		return nil, errOAuthTokenVersion
+	default:
+		return nil, errOAuthTokenMalformed
+	}
+
+	didBytes, err := decodeTokenSegment(did)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(didBytes), "did:") {
+		return nil, errOAuthTokenMalformed
+	}
+	tokenUUIDBytes, err := decodeTokenSegment(tokenUUID)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := decodeTokenSegment(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != 32 {
+		return nil, errOAuthTokenMalformed
+	}
+
+	return &oauthToken{
+		DID:           string(didBytes),
+		TokenUUID:     string(tokenUUIDBytes),
+		EncryptionKey: base64.StdEncoding.EncodeToString(keyBytes),
+	}, nil
+}
+
+// oauthTokenFromRequest gets the oauth token from the request's Authorization header.
+func oauthTokenFromRequest(c *fiber.Ctx) (*oauthToken, error) {
+	raw, ok := parseOAuthHeader(c.Get("Authorization"))["oauth_token"]
+	if !ok || raw == "" {
+		return nil, errOAuthTokenMissing
+	}
+	return parseOAuthToken(raw)
+}
+
+// sessionError turns an error from getting a session out of the DB into one of our token errors, if it's the token's fault.
+func sessionError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return errOAuthTokenUnknown
+	case errors.Is(err, db_controller.ErrWrongEncryptionKey):
+		return errOAuthTokenWrongKey
+	default:
+		return err
+	}
+}
+
+// authError tells the client why we couldn't work out who they are.
+func authError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errOAuthTokenMissing) {
+		return ReturnError(c, "Bad Authentication data", errorCodeBadAuthenticationData, fiber.StatusUnauthorized)
+	}
+	for _, tokenErr := range invalidTokenErrors {
+		if errors.Is(err, tokenErr) {
+			return ReturnError(c, "Invalid or expired token", errorCodeInvalidToken, fiber.StatusUnauthorized)
+		}
+	}
+	log.ErrorContext(c.UserContext(), "Failed to authenticate request", "error", err)
+	return ReturnError(c, "Could not authenticate you", errorCodeCouldNotAuthenticate, fiber.StatusUnauthorized)
+}
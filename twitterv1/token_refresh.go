@@ -0,0 +1,142 @@
+package twitterv1
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+)
+
+// Bluesky rotates refresh tokens, so if two requests refresh the same session at once, the one that loses ends up with a dead session.
+// Clients fire off a bunch of requests at once when they open, so this happens a lot.
+// Within this process, everyone waits on whoever started refreshing first. Between processes, the DB decides who gets to refresh.
+const (
+	tokenRefreshLease        = 30 * time.Second       // How long someone has to refresh a session before someone else can try
+	tokenRefreshPollInterval = 250 * time.Millisecond // How often we check if someone else has finished refreshing
+	// If we can't read when a new access token expires, we treat it as expiring after this, so it gets refreshed again soon.
+	unknownAccessTokenLifetime = 5 * time.Minute
+)
+
+var errRefreshTokenExpired = errors.New("refresh token has expired")
+
+// refreshDue decides whether a session still needs refreshing, given when its tokens expire.
+// It gets checked again after waiting on someone else, as they might have already done it for us.
+type refreshDue func(accessExpiry time.Time, refreshExpiry time.Time) bool
+
+// accessTokenExpired is what requests use, as they only need a working access token.
+func accessTokenExpired(accessExpiry time.Time, refreshExpiry time.Time) bool {
+	return accessExpiry.Before(time.Now())
+}
+
+type tokenRefreshCall struct {
+	done      chan struct{}
+	accessJwt string
+	err       error
+}
+
+var (
+	tokenRefreshCalls      = map[string]*tokenRefreshCall{}
+	tokenRefreshCallsMutex sync.Mutex
+)
+
+// refreshSession gets a fresh access token for a session, making sure only one refresh for it happens at a time.
+func refreshSession(ctx context.Context, did string, tokenUUID string, encryptionKey string, due refreshDue) (string, error) {
+	tokenRefreshCallsMutex.Lock()
+	if call, ok := tokenRefreshCalls[tokenUUID]; ok {
+		tokenRefreshCallsMutex.Unlock()
+		<-call.done
+		return call.accessJwt, call.err
+	}
+	call := &tokenRefreshCall{done: make(chan struct{})}
+	tokenRefreshCalls[tokenUUID] = call
+	tokenRefreshCallsMutex.Unlock()
+
+	// Other requests are waiting on this refresh, and bluesky rotates the refresh token, so it can't be cut short if this request goes away.
+	call.accessJwt, call.err = refreshSessionAcrossProcesses(context.WithoutCancel(ctx), did, tokenUUID, encryptionKey, due)
+
+	tokenRefreshCallsMutex.Lock()
+	delete(tokenRefreshCalls, tokenUUID)
+	tokenRefreshCallsMutex.Unlock()
+	close(call.done)
+
+	return call.accessJwt, call.err
+}
+
+// refreshSessionAcrossProcesses either refreshes the session, or waits for whoever is already refreshing it.
+func refreshSessionAcrossProcesses(ctx context.Context, did string, tokenUUID string, encryptionKey string, due refreshDue) (string, error) {
+	deadline := time.Now().Add(tokenRefreshLease + 5*time.Second)
+	for time.Now().Before(deadline) {
+		// The version has to be read before the tokens, so that if they change in between, our claim fails.
+		version, refreshingUntil, err := db_controller.GetTokenRefreshState(did, tokenUUID)
+		if err != nil {
+			return "", err
+		}
+		accessJwt, refreshJwt, accessExpiry, refreshExpiry, _, err := db_controller.GetToken(did, tokenUUID, encryptionKey)
+		if err != nil {
+			return "", err
+		}
+
+		// Someone else got there first
+		if !due(time.Unix(int64(*accessExpiry), 0), time.Unix(int64(*refreshExpiry), 0)) {
+			return *accessJwt, nil
+		}
+
+		if time.Unix(int64(*refreshExpiry), 0).Before(time.Now()) {
+			return "", errRefreshTokenExpired
+		}
+
+		if refreshingUntil == nil || refreshingUntil.Before(time.Now()) {
+			claimed, err := db_controller.ClaimTokenRefresh(did, tokenUUID, version, tokenRefreshLease)
+			if err != nil {
+				return "", err
+			}
+			if claimed {
+				return refreshClaimedSession(ctx, did, tokenUUID, encryptionKey, *refreshJwt, *refreshExpiry)
+			}
+		}
+
+		time.Sleep(tokenRefreshPollInterval)
+	}
+
+	return "", errors.New("timed out waiting for the session to be refreshed")
+}
+
+// refreshClaimedSession does the actual refresh, once we've claimed it.
+// oldRefreshExpiry is when the refresh token we're using expires, which the new one will last at least as long as.
+func refreshClaimedSession(ctx context.Context, did string, tokenUUID string, encryptionKey string, refreshJwt string, oldRefreshExpiry float64) (string, error) {
+	new_auth, err := blueskyapi.RefreshToken(ctx, refreshJwt)
+	if err != nil {
+		db_controller.AbandonTokenRefresh(did, tokenUUID)
+		return "", err
+	}
+
+	// Bluesky has already rotated the refresh token, so from here on the new tokens have to be stored no matter what.
+	access_token_expiry, err := bridge.GetJWTTokenExpirationUnix(new_auth.AccessJwt)
+	if err != nil {
+		log.WarnContext(ctx, "Failed to get access token expiry, refreshing again soon", "error", err)
+		fallback := float64(time.Now().Add(unknownAccessTokenLifetime).Unix())
+		access_token_expiry = &fallback
+	}
+	refresh_token_expiry, err := bridge.GetJWTTokenExpirationUnix(new_auth.RefreshJwt)
+	if err != nil {
+		log.WarnContext(ctx, "Failed to get refresh token expiry, keeping the old one", "error", err)
+		refresh_token_expiry = &oldRefreshExpiry
+	}
+
+	if err := db_controller.FinishTokenRefresh(did, tokenUUID, new_auth.AccessJwt, new_auth.RefreshJwt, encryptionKey, *access_token_expiry, *refresh_token_expiry); err != nil {
+		return "", err
+	}
+
+	// Sessions from before background refresh was turned on get picked up the next time they refresh.
+	if configData.BackgroundRefresh {
+		if err := storeWrappedEncryptionKey(did, tokenUUID, encryptionKey); err != nil {
+			log.ErrorContext(ctx, "Failed to store wrapped encryption key", "error", err)
+		}
+	}
+
+	return new_auth.AccessJwt, nil
+}
@@ -0,0 +1,70 @@
+package twitterv1
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseOAuthToken(t *testing.T) {
+	did := "did:plc:ewvi7nxzyoun6zhxrhs64oiz"
+	tokenUUID := "0b6a3d4e-9f1c-4c8a-b6a5-3f2e1d0c9b8a"
+	key := bytes.Repeat([]byte{0xfb}, 32) // Encodes with + & / in the standard alphabet
+	shortKey := bytes.Repeat([]byte{0xfb}, 16)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	padded := base64.URLEncoding.EncodeToString
+	v1 := func(segments ...string) string {
+		body := strings.Join(append([]string{oauthTokenVersion}, segments...), ".")
+		return body + "." + oauthTokenChecksumOf(body)
+	}
+
+	current := (&oauthToken{DID: did, TokenUUID: tokenUUID, EncryptionKey: base64.StdEncoding.EncodeToString(key)}).String()
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr error
+	}{
+		{"v1 round trip", current, nil},
+		{"legacy", b64([]byte(did)) + "." + b64([]byte(tokenUUID)) + "." + b64(key), nil},
+		{"legacy with padding", padded([]byte(did)) + "." + padded([]byte(tokenUUID)) + "." + padded(key), nil},
+		{"legacy with a standard base64 key", b64([]byte(did)) + "." + b64([]byte(tokenUUID)) + "." + base64.StdEncoding.EncodeToString(key), nil},
+		{"bad checksum", current[:len(current)-1] + "A", errOAuthTokenChecksum},
+		{"truncated checksum", current[:len(current)-3], errOAuthTokenChecksum},
+		{"truncated", current[:strings.LastIndex(current, ".")], errOAuthTokenMalformed},
+		{"too few segments", b64([]byte(did)) + "." + b64([]byte(tokenUUID)), errOAuthTokenMalformed},
+		{"too many segments", current + ".extra", errOAuthTokenMalformed},
+		{"one segment", "garbage", errOAuthTokenMalformed},
+		{"empty", "", errOAuthTokenMalformed},
+		{"unknown version", "tb2." + b64([]byte(did)) + "." + b64([]byte(tokenUUID)) + "." + b64(key) + ".abc", errOAuthTokenVersion},
+		{"short key", v1(b64([]byte(did)), b64([]byte(tokenUUID)), b64(shortKey)), errOAuthTokenMalformed},
+		{"legacy short key", b64([]byte(did)) + "." + b64([]byte(tokenUUID)) + "." + b64(shortKey), errOAuthTokenMalformed},
+		{"not a DID", v1(b64([]byte("alice")), b64([]byte(tokenUUID)), b64(key)), errOAuthTokenMalformed},
+		{"empty segment", v1(b64([]byte(did)), "", b64(key)), errOAuthTokenMalformed},
+		{"not base64", v1(b64([]byte(did)), "!!!", b64(key)), errOAuthTokenMalformed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := parseOAuthToken(test.raw)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if token.DID != did || token.TokenUUID != tokenUUID || token.EncryptionKey != base64.StdEncoding.EncodeToString(key) {
+				t.Fatalf("got %+v", token)
+			}
+			if token.String() != current {
+				t.Errorf("re-encoded as %q, want %q", token.String(), current)
+			}
+		})
+	}
+}
@@ -2,33 +2,69 @@ package twitterv1
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/Preloading/MastodonTwitterAPI/bridge"
+	"github.com/Preloading/MastodonTwitterAPI/config"
+	"github.com/Preloading/MastodonTwitterAPI/db_controller"
+	"github.com/Preloading/MastodonTwitterAPI/logging"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/google/uuid"
 )
 
-func InitServer() {
-	app := fiber.New()
+var configData *config.Config
 
-	// Initialize default config
-	app.Use(logger.New())
+var log = logging.For("twitterv1")
 
-	// Custom middleware to log request details
-	app.Use(func(c *fiber.Ctx) error {
-		// fmt.Println("Request Method:", c.Method())
-		fmt.Println("Request URL:", c.OriginalURL())
-		// fmt.Println("Post Body:", string(c.Body()))
-		// fmt.Println("Headers:", string(c.Request().Header.Header()))
-		// fmt.Println()
-		return c.Next()
+func InitServer(cfg *config.Config) {
+	configData = cfg
+	app := fiber.New(fiber.Config{
+		BodyLimit: maxRequestBodySize,
 	})
 
+	if err := checkAccessPolicy(cfg.AccessPolicy); err != nil {
+		panic(err)
+	}
+
+	if cfg.BackgroundRefresh {
+		if err := checkServerKey(cfg.ServerKey); err != nil {
+			panic(err)
+		}
+		go runBackgroundRefresh()
+	} else {
+		// If it's been turned off, we shouldn't be able to get into anyone's session anymore.
+		if err := db_controller.ClearWrappedEncryptionKeys(); err != nil {
+			panic(err)
+		}
+	}
+
+	if cfg.MetricsAddress != "" {
+		go serveMetrics(cfg.MetricsAddress)
+	}
+
+	// Give each request an ID to find its logs by, and log it once it's done
+	app.Use(RequestLogMiddleware)
+
+	// Make sure requests really came from the app they say they did
+	go forgetOldOAuthNonces()
+	app.Use(OAuthSignatureMiddleware)
+
+	// Count requests against each token's rate limit
+	app.Use(RateLimitMiddleware)
+
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, World!")
 	})
 
 	// Auth
+	app.Post("/oauth/request_token", RequestToken)
+	app.Get("/oauth/authorize", AuthorizePage)
+	app.Get("/oauth/authenticate", AuthorizePage)
+	app.Post("/oauth/authorize", Authorize)
 	app.Post("/oauth/access_token", access_token)
+	app.Get("/invite", InvitePage)
+	app.Post("/invite", RedeemInvite)
 
 	// Interactions
 	app.Post("/1/statuses/update.json", status_update)
@@ -38,19 +74,48 @@ func InitServer() {
 
 	// Posts
 	app.Get("/1/statuses/home_timeline.json", home_timeline)
+	app.Get("/1/statuses/public_timeline.json", public_timeline)
+	app.Get("/1/statuses/retweets_of_me.json", RetweetsOfMe)
+	app.Get("/1/statuses/retweeted_by_me.json", RetweetedByMe)
+	app.Get("/1/statuses/retweeted_to_me.json", RetweetedToMe)
 	app.Get("/1/statuses/show/:id.json", GetStatusFromId)
+	app.Get("/1/statuses/oembed.json", StatusOEmbed)
 	app.Get("/i/statuses/:id/activity/summary.json", TweetInfo)
 
+	// Activity
+	app.Get("/i/activity/by_friends.json", ActivityByFriends)
+
 	// Users
 	app.Get("/1/users/show.xml", user_info)
 	app.Get("/1/users/lookup.json", UserLookup)
+	app.Get("/1/users/suggestions.json", SuggestionCategories)
+	app.Get("/1/users/suggestions/:slug.json", SuggestionCategoryUsers)
+	app.Get("/1/users/recommendations.json", UserRecommendations)
+	app.Get("/1/users/profile_image/:screen_name", ProfileImage)
 
 	// Trends
 	app.Get("/1/trends/:woeid.json", trends_woeid)
 
+	// Search, which twitter had on search.twitter.com
+	app.Get("/search.json", Search)
+
 	// Setings
 	app.Get("/1/account/settings.xml", GetSettings)
+	app.Get("/1/account/settings.json", GetSettings)
+	app.Post("/1/account/settings.xml", UpdateSettings)
+	app.Post("/1/account/settings.json", UpdateSettings)
 	app.Get("/1/account/push_destinations/device.xml", PushDestinations)
+	app.Post("/1/account/push_destinations/destroy.xml", DestroyPushDestination)
+
+	app.Get("/1/account/rate_limit_status.json", RateLimitStatusHandler)
+
+	// Profile
+	app.Post("/1/account/update_profile.json", UpdateProfile)
+	app.Post("/1/account/update_profile_image.json", UpdateProfileImage)
+	app.Post("/1/account/update_profile_banner.json", UpdateProfileBanner)
+
+	// Help
+	app.Get("/1/help/configuration.json", HelpConfiguration)
 
 	// Legal cuz why not?
 	app.Get("/1/legal/tos.json", TOS)
@@ -59,5 +124,64 @@ func InitServer() {
 	// CDN Downscaler
 	app.Get("/cdn/img", CDNDownscaler)
 
-	app.Listen(":3000")
+	app.Listen(fmt.Sprintf(":%d", cfg.Port))
+}
+
+// Twitter's error codes, from https://web.archive.org/web/20121016001003/https://dev.twitter.com/docs/error-codes-responses
+const (
+	errorCodeCouldNotAuthenticate  = 32
+	errorCodeNotFound              = 34
+	errorCodeMissingParameter      = 38
+	errorCodeAccountSuspended      = 64
+	errorCodeRateLimitExceeded     = 88
+	errorCodeInvalidToken          = 89
+	errorCodeAccountUpdateFailed   = 120
+	errorCodeInternalError         = 131
+	errorCodeTimestampOutOfBounds  = 135
+	errorCodeBadAuthenticationData = 215
+	errorCodeAccessDenied          = 220
+	errorCodeLoginVerification     = 231
+	errorCodeInvalidImage          = 324
+)
+
+// serverURL gets the address clients reach us at, without a trailing slash.
+// Unless one has been configured, it's the address this request was made to.
+func serverURL(c *fiber.Ctx) string {
+	if configData.URL != "" {
+		return strings.TrimSuffix(configData.URL, "/")
+	}
+	return c.BaseURL()
+}
+
+// ReturnError sends an error in the format that twitter clients expect, so they can show the user something useful.
+func ReturnError(c *fiber.Ctx, message string, code int, status int) error {
+	return c.Status(status).JSON(bridge.TwitterErrors{
+		Errors: []bridge.TwitterError{
+			{
+				Message: message,
+				Code:    code,
+			},
+		},
+	})
+}
+
+// RequestLogMiddleware tags everything logged during a request with a request ID, which is also sent back in X-Request-ID.
+// The URL goes through the log redaction like everything else, so tokens & passwords in the query string don't end up in the logs.
+func RequestLogMiddleware(c *fiber.Ctx) error {
+	requestID := uuid.NewString()
+	c.Set(fiber.HeaderXRequestID, requestID)
+	c.SetUserContext(logging.WithRequestID(c.UserContext(), requestID))
+
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if fiberErr, ok := err.(*fiber.Error); ok {
+		status = fiberErr.Code
+	} else if err != nil {
+		status = fiber.StatusInternalServerError
+	}
+	log.InfoContext(c.UserContext(), "Request", "method", c.Method(), "url", c.OriginalURL(), "status", status, "latency", time.Since(start), "ip", c.IP())
+
+	return err
 }
@@ -2,7 +2,12 @@ package twitterv1
 
 import (
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"math/big"
+	"net/url"
 	"strings"
 
 	blueskyapi "github.com/Preloading/MastodonTwitterAPI/bluesky"
@@ -45,16 +50,16 @@ func user_info(c *fiber.Ctx) error {
 		oauthToken = &blankstring
 	}
 
-	userinfo, err := blueskyapi.GetUserInfo(*oauthToken, screen_name)
+	userinfo, err := blueskyapi.GetUserInfo(c.UserContext(), *oauthToken, screen_name)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to fetch user info", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch user info")
 	}
 
 	xml, err := bridge.XMLEncoder(userinfo, "TwitterUser", "user")
 	if err != nil {
-		fmt.Println("Error:", err)
+		log.ErrorContext(c.UserContext(), "Failed to encode user info", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to encode user info")
 	}
 
@@ -102,9 +107,9 @@ func UserLookup(c *fiber.Ctx) error {
 	var users []bridge.TwitterUser
 
 	for _, group := range userLookupGroups {
-		usersGroup, err := blueskyapi.GetUsersInfo(*oauthToken, group)
+		usersGroup, err := blueskyapi.GetUsersInfo(c.UserContext(), *oauthToken, group)
 		if err != nil {
-			fmt.Println("Error:", err)
+			log.ErrorContext(c.UserContext(), "Failed to fetch user info", "error", err)
 			return c.Status(fiber.StatusInternalServerError).SendString("Failed to fetch user info")
 		}
 		for _, user := range usersGroup {
@@ -114,3 +119,52 @@ func UserLookup(c *fiber.Ctx) error {
 
 	return c.JSON(users)
 }
+
+// The sizes twitter used for profile images. Original means we don't resize it at all.
+var profileImageSizes = map[string]int{
+	"mini":     24,
+	"normal":   48,
+	"bigger":   73,
+	"original": 0,
+}
+
+// The colour of the profile image we use for users without one.
+var defaultProfileImageColor = color.RGBA{R: 0x8c, G: 0xa1, B: 0xae, A: 0xff}
+
+// https://web.archive.org/web/20120508165240/https://dev.twitter.com/docs/api/1/get/users/profile_image/%3Ascreen_name
+func ProfileImage(c *fiber.Ctx) error {
+	screen_name := c.Params("screen_name")
+	// Handles can have dots in them, so we can only remove the extensions we know about
+	screen_name = strings.TrimSuffix(strings.TrimSuffix(screen_name, ".json"), ".xml")
+
+	sizeName := c.Query("size", "normal")
+	size, ok := profileImageSizes[sizeName]
+	if !ok {
+		size = profileImageSizes["normal"]
+	}
+
+	author, err := blueskyapi.GetProfile(c.UserContext(), "", screen_name)
+	if err != nil {
+		log.ErrorContext(c.UserContext(), "Failed to fetch profile", "error", err)
+		return ReturnError(c, "Sorry, that page does not exist", errorCodeNotFound, fiber.StatusNotFound)
+	}
+
+	if author.Avatar == "" {
+		// Bluesky doesn't have a default profile image, so we make our own.
+		if size == 0 {
+			size = 500
+		}
+		img := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.Draw(img, img.Bounds(), &image.Uniform{defaultProfileImageColor}, image.Point{}, draw.Src)
+
+		c.Set("Content-Type", "image/png")
+		return png.Encode(c.Response().BodyWriter(), img)
+	}
+
+	imageURL := "/cdn/img/?url=" + url.QueryEscape(author.Avatar)
+	if size != 0 {
+		imageURL += fmt.Sprintf("&width=%d&height=%d", size, size)
+	}
+
+	return c.Redirect(imageURL, fiber.StatusFound)
+}